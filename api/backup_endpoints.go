@@ -11,6 +11,65 @@ type BackupRequest struct {
 	ChecksumType string `json:"checksum_type"`
 	Size         int64  `json:"size"`
 	Successful   bool   `json:"successful"`
+	Encryption   string `json:"encryption"`
+}
+
+type BackupRemoteUploadResponse struct {
+	// The presigned URLs that each part of the backup should be uploaded to, in order.
+	Parts []string `json:"parts"`
+
+	// The size of each part, only the final part is allowed to be smaller than this.
+	PartSize int64 `json:"part_size"`
+
+	// The presigned URLs used to complete the multipart upload once every part has been
+	// uploaded, or to abort it if the backup fails.
+	CompleteUrl string `json:"complete_url"`
+	AbortUrl    string `json:"abort_url"`
+}
+
+// Requests the presigned URLs for a multipart upload of a backup to S3. The size is the
+// largest that the archive can possibly be, the panel uses it to determine how many parts
+// need to be generated.
+func (r *Request) GetBackupRemoteUploadURLs(backup string, size int64) (*BackupRemoteUploadResponse, error) {
+	resp, err := r.Get(fmt.Sprintf("/backups/%s?size=%d", backup, size), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return nil, resp.Error()
+	}
+
+	var res BackupRemoteUploadResponse
+	if err := resp.Bind(&res); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &res, nil
+}
+
+// Requests the key that was used to encrypt a specific backup from the panel. An empty key is
+// returned if the backup was encrypted using the key configured for the node.
+func (r *Request) GetBackupEncryptionKey(backup string) (string, error) {
+	resp, err := r.Get(fmt.Sprintf("/backups/%s/encryption-key", backup), nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return "", resp.Error()
+	}
+
+	var res struct {
+		EncryptionKey string `json:"encryption_key"`
+	}
+	if err := resp.Bind(&res); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return res.EncryptionKey, nil
 }
 
 // Notifies the panel that a specific backup has been completed and is now
@@ -27,5 +86,66 @@ func (r *Request) SendBackupStatus(backup string, data BackupRequest) error {
 	}
 	defer resp.Body.Close()
 
-	return resp.Error()
+	if resp.HasError() {
+		return resp.Error()
+	}
+
+	return nil
+}
+
+type BackupVerificationRequest struct {
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+	Successful   bool   `json:"successful"`
+	// Set when the backup could not be decrypted to check it, rather than it being corrupted.
+	Unverifiable bool   `json:"unverifiable"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Notifies the panel of the result of verifying the integrity of a backup. If the backup
+// failed verification the reason is included in the request.
+func (r *Request) SendBackupVerificationStatus(backup string, data BackupVerificationRequest) error {
+	resp, err := r.Post(fmt.Sprintf("/backups/%s/verify", backup), data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return resp.Error()
+	}
+
+	return nil
+}
+
+// Notifies the panel that a backup was removed from the node by the retention policy, allowing
+// the panel to remove it from the list of backups for the server.
+func (r *Request) SendBackupPruned(backup string) error {
+	resp, err := r.Post(fmt.Sprintf("/backups/%s/prune", backup), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return resp.Error()
+	}
+
+	return nil
+}
+
+// Notifies the panel that a specific backup has finished being restored to a server
+// and indicates if the restoration process was successful or not.
+func (r *Request) SendRestorationStatus(backup string, successful bool) error {
+	resp, err := r.Post(fmt.Sprintf("/backups/%s/restore", backup), D{"successful": successful})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return resp.Error()
+	}
+
+	return nil
 }
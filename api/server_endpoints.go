@@ -189,6 +189,30 @@ func (r *Request) SendArchiveStatus(uuid string, successful bool) error {
 	return resp.Error()
 }
 
+// Requests a new token from the panel that can be used to download the files for a server
+// being transferred to this node from the source node. This is used when resuming a transfer,
+// since the token sent with the original request is never stored.
+func (r *Request) GetTransferToken(uuid string) (string, error) {
+	resp, err := r.Get(fmt.Sprintf("/servers/%s/transfer/token", uuid), nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return "", resp.Error()
+	}
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := resp.Bind(&res); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return res.Token, nil
+}
+
 func (r *Request) SendTransferFailure(uuid string) error {
 	resp, err := r.Get(fmt.Sprintf("/servers/%s/transfer/failure", uuid), nil)
 	if err != nil {
@@ -4,11 +4,22 @@ import (
 	"github.com/apex/log"
 	"github.com/pkg/errors"
 	"regexp"
+	"time"
 )
 
+const (
+	SftpAuthPassword  = "password"
+	SftpAuthPublicKey = "public_key"
+)
+
+// The request sent to the Panel when a user attempts to login to the SFTP server. Type is
+// either "password" or "public_key", when logging in with a public key the SHA256 fingerprint
+// of the key is sent in place of a password.
 type SftpAuthRequest struct {
+	Type          string `json:"type"`
 	User          string `json:"username"`
-	Pass          string `json:"password"`
+	Pass          string `json:"password,omitempty"`
+	Key           string `json:"key,omitempty"`
 	IP            string `json:"ip"`
 	SessionID     []byte `json:"session_id"`
 	ClientVersion []byte `json:"client_version"`
@@ -18,6 +29,9 @@ type SftpAuthResponse struct {
 	Server      string   `json:"server"`
 	Token       string   `json:"token"`
 	Permissions []string `json:"permissions"`
+	// The paths within the server that the user is limited to. If empty the user is able to
+	// access every file for the server.
+	Paths []string `json:"paths"`
 }
 
 type sftpInvalidCredentialsError struct {
@@ -82,3 +96,30 @@ func (r *Request) ValidateSftpCredentials(request SftpAuthRequest) (*SftpAuthRes
 
 	return &response, nil
 }
+
+// A single action performed by a user over SFTP that modified the files for a server. Target
+// is only set for actions that have a destination, such as renaming a file.
+type SftpActivity struct {
+	Server    string    `json:"server"`
+	User      string    `json:"username"`
+	IP        string    `json:"ip"`
+	Action    string    `json:"action"`
+	Path      string    `json:"path"`
+	Target    string    `json:"target,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Sends a batch of SFTP activity to the Panel so that it can be recorded for each server.
+func (r *Request) SendSftpActivity(activity []SftpActivity) error {
+	resp, err := r.Post("/sftp/activity", D{"data": activity})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.HasError() {
+		return resp.Error()
+	}
+
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/mitchellh/colorstring"
@@ -25,8 +26,10 @@ import (
 	"github.com/pterodactyl/wings/environment"
 	"github.com/pterodactyl/wings/router"
 	"github.com/pterodactyl/wings/server"
+	"github.com/pterodactyl/wings/server/backup"
 	"github.com/pterodactyl/wings/sftp"
 	"github.com/pterodactyl/wings/system"
+	"github.com/pterodactyl/wings/webdav"
 	"github.com/spf13/cobra"
 )
 
@@ -252,16 +255,29 @@ func rootCmdRun(*cobra.Command, []string) {
 		return
 	}
 
+	// Initialize the WebDAV server, if it has been enabled.
+	if err := webdav.Initialize(c); err != nil {
+		log.WithError(err).Fatal("failed to initialize the webdav server")
+		return
+	}
+
 	// Ensure the archive directory exists.
 	if err := os.MkdirAll(c.System.ArchiveDirectory, 0755); err != nil {
 		log.WithField("error", err).Error("failed to create archive directory")
 	}
 
+	// Pick up any incoming server transfers that were interrupted when wings was stopped.
+	router.ResumeTransfers()
+
 	// Ensure the backup directory exists.
 	if err := os.MkdirAll(c.System.BackupDirectory, 0755); err != nil {
 		log.WithField("error", err).Error("failed to create backup directory")
 	}
 
+	if c.System.Backups.VerifyInterval > 0 {
+		go backup.VerifyPeriodically(time.Duration(c.System.Backups.VerifyInterval) * time.Minute)
+	}
+
 	log.WithFields(log.Fields{
 		"use_ssl":      c.Api.Ssl.Enabled,
 		"use_auto_tls": useAutomaticTls && len(tlsHostname) > 0,
@@ -53,6 +53,12 @@ type Configuration struct {
 	// the assigned disk limits.
 	DiskCheckTimeout int `yaml:"disk_check_timeout"`
 
+	// Bandwidth limits applied to server transfers between nodes, and to the downloading of
+	// backups and server files. These can be changed at runtime and apply to any transfer or
+	// download that is already running.
+	TransferRateLimit RateLimitConfiguration `json:"transfer_rate_limit" yaml:"transfer_rate_limit"`
+	DownloadRateLimit RateLimitConfiguration `json:"download_rate_limit" yaml:"download_rate_limit"`
+
 	// Defines internal throttling configurations for server processes to prevent
 	// someone from running an endless loop that spams data to logs.
 	Throttles ConsoleThrottles
@@ -72,6 +78,14 @@ type Configuration struct {
 	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
 }
 
+// Defines a bandwidth limit in bytes per second. The node limit caps the combined rate of every
+// request on the node, and the request limit caps each individual request. Setting either limit
+// to zero disables it.
+type RateLimitConfiguration struct {
+	Node    int64 `default:"0" json:"node" yaml:"node"`
+	Request int64 `default:"0" json:"request" yaml:"request"`
+}
+
 // Defines the configuration of the internal SFTP server.
 type SftpConfiguration struct {
 	// The bind address of the SFTP server.
@@ -80,6 +94,39 @@ type SftpConfiguration struct {
 	Port int `default:"2022" json:"bind_port" yaml:"bind_port"`
 	// If set to true, no write actions will be allowed on the SFTP server.
 	ReadOnly bool `default:"false" yaml:"read_only"`
+
+	// The rules used to block logins from an IP address or for a username after too many
+	// failed login attempts, to avoid flooding the Panel with invalid login requests.
+	Lockout SftpLockoutConfiguration `json:"lockout" yaml:"lockout"`
+}
+
+// Defines the configuration of the internal WebDAV server. Users login with the same credentials
+// they use for the SFTP server, and the same permissions and read only setting are applied. If
+// SSL is enabled for the API the same certificate is used for the WebDAV server. Credentials are
+// sent with every request, so SSL should always be enabled when the WebDAV server is.
+type WebDavConfiguration struct {
+	// If set to true a WebDAV server is started alongside the SFTP server.
+	Enabled bool `default:"false" json:"enabled" yaml:"enabled"`
+	// The bind address of the WebDAV server.
+	Address string `default:"0.0.0.0" json:"bind_address" yaml:"bind_address"`
+	// The bind port of the WebDAV server.
+	Port int `default:"2023" json:"bind_port" yaml:"bind_port"`
+}
+
+// Defines when logins to the SFTP server are blocked after a number of failed attempts.
+type SftpLockoutConfiguration struct {
+	// The number of failed logins allowed from a single IP address, or for a single username,
+	// before any further attempts are blocked. Setting this to zero disables the lockout.
+	MaxAttempts int `default:"10" json:"max_attempts" yaml:"max_attempts"`
+
+	// The number of seconds that logins are blocked for the first time the maximum number of
+	// attempts is reached. This doubles each time logins are blocked again, up to the maximum
+	// ban duration.
+	BanDuration int `default:"60" json:"ban_duration" yaml:"ban_duration"`
+
+	// The maximum number of seconds that logins can be blocked for. Failed attempts that are
+	// older than this are forgotten.
+	MaxBanDuration int `default:"3600" json:"max_ban_duration" yaml:"max_ban_duration"`
 }
 
 // Defines the configuration for the internal API that is exposed by the
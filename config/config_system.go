@@ -32,6 +32,12 @@ type SystemConfiguration struct {
 	// Directory where local backups will be stored on the machine.
 	BackupDirectory string `default:"/var/lib/pterodactyl/backups" yaml:"backup_directory"`
 
+	// A base64 encoded 32 byte key used to encrypt local and S3 backup archives created on
+	// this node with AES-256-GCM. The panel can override this on a per-backup basis. If no key
+	// is set here or provided by the panel backups are stored without encryption. Incremental
+	// backups are never encrypted.
+	BackupEncryptionKey string `yaml:"backup_encryption_key"`
+
 	// The user that should own all of the server files, and be used for containers.
 	Username string `default:"pterodactyl" yaml:"username"`
 
@@ -71,6 +77,51 @@ type SystemConfiguration struct {
 	EnableLogRotate bool `default:"true" yaml:"enable_log_rotate"`
 
 	Sftp SftpConfiguration `yaml:"sftp"`
+
+	WebDav WebDavConfiguration `json:"webdav" yaml:"webdav"`
+
+	Backups BackupConfiguration `yaml:"backups"`
+}
+
+// Defines the limits applied to the generation of backups on this node.
+type BackupConfiguration struct {
+	// The maximum number of backups that can be generated at the same time across every
+	// server on the node. Any additional backups are queued until a slot is available. Setting
+	// this to zero removes the limit.
+	ConcurrentJobs int `default:"0" json:"concurrent_jobs" yaml:"concurrent_jobs"`
+
+	// The maximum number of bytes per second that can be read from the disk while generating
+	// backups. This limit is shared between every backup running on the node. Setting this to
+	// zero removes the limit.
+	ReadLimit int64 `default:"0" json:"read_limit" yaml:"read_limit"`
+
+	// The number of minutes between each verification of every backup stored on the node.
+	// Each backup is read in full and the result is reported to the panel. Setting this to
+	// zero disables the periodic verification.
+	VerifyInterval int `default:"0" json:"verify_interval" yaml:"verify_interval"`
+
+	// The rules used to prune old backups that are stored on this node. These are evaluated
+	// for a server every time a backup is successfully generated for it.
+	Retention BackupRetentionConfiguration `json:"retention" yaml:"retention"`
+}
+
+// Defines which backups stored on the node are kept for each server. A backup is kept if it
+// matches either the keep last or keep daily rule, and then the oldest of those are removed
+// until the total size is within the limit. Setting every value to zero disables pruning.
+//
+// Backups are matched to a server using the manifest stored alongside them, so any backup that
+// was generated before manifests were stored is never pruned and must be removed through the
+// panel instead.
+type BackupRetentionConfiguration struct {
+	// The number of the most recent backups to keep for each server.
+	KeepLast int `default:"0" json:"keep_last" yaml:"keep_last"`
+
+	// The number of days to keep the most recent backup of each day for.
+	KeepDaily int `default:"0" json:"keep_daily" yaml:"keep_daily"`
+
+	// The maximum total size in bytes of the backups kept for each server. The most recent
+	// backup is always kept, even if it alone is larger than this.
+	MaxSize int64 `default:"0" json:"max_size" yaml:"max_size"`
 }
 
 // Ensures that all of the system directories exist on the system. These directories are
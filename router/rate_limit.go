@@ -0,0 +1,54 @@
+package router
+
+import (
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/system"
+	"io"
+	"net/http"
+)
+
+// The bandwidth limits applied to server transfers and to downloads from the node. Each
+// transfer or download acquires its own member of the group, so that both the per-request
+// and the node wide limits are applied to it.
+var (
+	transferLimits = system.NewRateLimitGroup(0, 0)
+	downloadLimits = system.NewRateLimitGroup(0, 0)
+)
+
+// Updates the bandwidth limits using the current configuration. Any transfer or download
+// that is currently running is adjusted to the new limits.
+func updateRateLimits() {
+	c := config.Get()
+
+	transferLimits.SetLimits(c.TransferRateLimit.Node, c.TransferRateLimit.Request)
+	downloadLimits.SetLimits(c.DownloadRateLimit.Node, c.DownloadRateLimit.Request)
+}
+
+// A response writer that writes the body of the response through a rate limited writer.
+type rateLimitedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+var (
+	_ http.Flusher  = (*rateLimitedResponseWriter)(nil)
+	_ io.ReaderFrom = (*rateLimitedResponseWriter)(nil)
+)
+
+func (w *rateLimitedResponseWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+// Flushes any buffered data to the client, if the underlying response writer supports it.
+func (w *rateLimitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Copies everything from r into the response. The underlying response writer is able to send
+// files without copying them through userspace, which would bypass the limit, so everything
+// is always copied through the rate limited writer instead.
+func (w *rateLimitedResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w.w}, r)
+}
@@ -9,6 +9,8 @@ import (
 func Configure() *gin.Engine {
 	gin.SetMode("release")
 
+	updateRateLimits()
+
 	router := gin.New()
 
 	router.Use(gin.Recovery())
@@ -46,6 +48,9 @@ func Configure() *gin.Engine {
 	// This request does not need the AuthorizationMiddleware as the panel should never call it
 	// and requests are authenticated through a JWT the panel issues to the other daemon.
 	router.GET("/api/servers/:server/archive", ServerExists, getServerArchive)
+	router.POST("/api/servers/:server/archive/final", ServerExists, postServerArchiveFinal)
+	router.GET("/api/servers/:server/archive/deleted", ServerExists, getServerArchiveDeletedFiles)
+	router.DELETE("/api/servers/:server/archive/snapshot", ServerExists, deleteServerArchiveSnapshot)
 
 	// All of the routes beyond this mount will use an authorization middleware
 	// and will not be accessible without the correct Authorization header provided.
@@ -55,6 +60,9 @@ func Configure() *gin.Engine {
 	protected.GET("/api/servers", getAllServers)
 	protected.POST("/api/servers", postCreateServer)
 	protected.POST("/api/transfer", postTransfer)
+	protected.GET("/api/sftp/bans", getSftpBans)
+	protected.DELETE("/api/sftp/bans", deleteSftpBans)
+	protected.DELETE("/api/sftp/bans/:type/:value", deleteSftpBan)
 
 	// These are server specific routes, and require that the request be authorized, and
 	// that the server exist on the Daemon.
@@ -88,10 +96,22 @@ func Configure() *gin.Engine {
 			files.POST("/decompress", postServerDecompressFiles)
 		}
 
+		sftp := server.Group("/sftp")
+		{
+			sftp.GET("/sessions", getServerSftpSessions)
+			sftp.DELETE("/sessions/:session", deleteServerSftpSession)
+		}
+
 		backup := server.Group("/backup")
 		{
 			backup.POST("", postServerBackup)
+			backup.GET("/:backup/contents", getServerBackupContents)
+			backup.POST("/:backup/contents", postServerBackupContents)
+			backup.POST("/:backup/restore", postServerRestoreBackup)
+			backup.POST("/:backup/restore/files", postServerRestoreBackupFiles)
+			backup.POST("/:backup/verify", postServerVerifyBackup)
 			backup.DELETE("/:backup", deleteServerBackup)
+			backup.DELETE("/:backup/job", deleteServerBackupJob)
 		}
 	}
 
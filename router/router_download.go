@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/pterodactyl/wings/api"
 	"github.com/pterodactyl/wings/router/tokens"
 	"github.com/pterodactyl/wings/server/backup"
 	"net/http"
@@ -27,7 +28,12 @@ func getDownloadBackup(c *gin.Context) {
 		return
 	}
 
-	b, st, err := backup.LocateLocal(token.BackupUuid)
+	b, err := locateStoredBackup(token.BackupUuid)
+	// S3 backups are downloaded directly from the bucket, only the manifest is stored here.
+	if _, ok := b.(*backup.S3Backup); ok {
+		err = os.ErrNotExist
+	}
+
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
@@ -40,6 +46,21 @@ func getDownloadBackup(c *gin.Context) {
 		return
 	}
 
+	// Incremental backups are not stored as a single archive, so build one on the fly from
+	// the chunks that make up the backup. The final size is not known ahead of time.
+	if ib, ok := b.(*backup.IncrementalBackup); ok {
+		c.Header("Content-Disposition", "attachment; filename="+ib.Identifier()+".tar.gz")
+		c.Header("Content-Type", "application/octet-stream")
+
+		m := downloadLimits.Acquire()
+		defer m.Release()
+
+		if err := ib.WriteArchive(m.Writer(c.Writer)); err != nil {
+			s.Log().WithField("error", err).Error("failed to stream incremental backup archive")
+		}
+		return
+	}
+
 	f, err := os.Open(b.Path())
 	if err != nil {
 		TrackedServerError(err, s).AbortWithServerError(c)
@@ -47,11 +68,42 @@ func getDownloadBackup(c *gin.Context) {
 	}
 	defer f.Close()
 
-	c.Header("Content-Length", strconv.Itoa(int(st.Size())))
+	st, err := f.Stat()
+	if err != nil {
+		TrackedServerError(err, s).AbortWithServerError(c)
+		return
+	}
+
+	// Encrypted backups are decrypted on the fly so that the user receives a normal archive,
+	// the final size of the decrypted archive is not known so no length is sent. The key is
+	// requested from the panel rather than being included in the token, since the token is
+	// handed to the user.
+	br := bufio.NewReader(f)
+
+	var key string
+	if backup.IsEncrypted(br) {
+		if key, err = api.New().GetBackupEncryptionKey(token.BackupUuid); err != nil {
+			TrackedServerError(err, s).AbortWithServerError(c)
+			return
+		}
+	}
+
+	r, encrypted, err := backup.DecryptReader(br, key)
+	if err != nil {
+		TrackedServerError(err, s).AbortWithServerError(c)
+		return
+	}
+
+	if !encrypted {
+		c.Header("Content-Length", strconv.Itoa(int(st.Size())))
+	}
 	c.Header("Content-Disposition", "attachment; filename="+st.Name())
 	c.Header("Content-Type", "application/octet-stream")
 
-	bufio.NewReader(f).WriteTo(c.Writer)
+	m := downloadLimits.Acquire()
+	defer m.Release()
+
+	bufio.NewReader(r).WriteTo(m.Writer(c.Writer))
 }
 
 // Handles downloading a specific file for a server.
@@ -94,5 +146,8 @@ func getDownloadFile(c *gin.Context) {
 	c.Header("Content-Disposition", "attachment; filename="+st.Name())
 	c.Header("Content-Type", "application/octet-stream")
 
-	bufio.NewReader(f).WriteTo(c.Writer)
+	m := downloadLimits.Acquire()
+	defer m.Release()
+
+	bufio.NewReader(f).WriteTo(m.Writer(c.Writer))
 }
@@ -7,6 +7,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/pterodactyl/wings/server"
+	"github.com/pterodactyl/wings/sftp"
+	"github.com/pterodactyl/wings/webdav"
 	"net/http"
 	"os"
 	"strconv"
@@ -86,6 +88,13 @@ func postServerPower(c *gin.Context) {
 		return
 	}
 
+	if data.Action.IsStart() && s.IsRestoring() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Cannot start or restart a server that is currently restoring a backup.",
+		})
+		return
+	}
+
 	// Pass the actual heavy processing off to a separate thread to handle so that
 	// we can immediately return a response from the server. Some of these actions
 	// can take quite some time, especially stopping or restarting.
@@ -149,6 +158,12 @@ func patchServer(c *gin.Context) {
 
 	s.SyncWithEnvironment()
 
+	// Anyone connected over SFTP or WebDAV should lose access as soon as the server is suspended.
+	if s.IsSuspended() {
+		sftp.DisconnectServer(s.Id())
+		webdav.DisconnectServer(s.Id())
+	}
+
 	c.Status(http.StatusNoContent)
 }
 
@@ -204,10 +219,16 @@ func deleteServer(c *gin.Context) {
 		s.Log().WithField("error", err).Warn("failed to delete server archive during deletion process")
 	}
 
+	if err := s.Archiver.RemoveSnapshot(); err != nil {
+		s.Log().WithField("error", err).Warn("failed to delete transfer snapshot during deletion process")
+	}
+
 	// Unsubscribe all of the event listeners.
 	s.Events().Destroy()
 	s.Throttler().StopTimer()
 	s.Websockets().CancelAll()
+	sftp.DisconnectServer(s.Id())
+	webdav.DisconnectServer(s.Id())
 
 	// Destroy the environment; in Docker this will handle a running container and
 	// forcibly terminate it before removing the container, so we do not need to handle
@@ -19,6 +19,7 @@ func postServerBackup(c *gin.Context) {
 	if err := c.BindJSON(&data); err != nil {
 		return
 	}
+	data.Server = s.Id()
 
 	var adapter backup.BackupInterface
 	var err error
@@ -28,6 +29,8 @@ func postServerBackup(c *gin.Context) {
 		adapter, err = data.NewLocalBackup()
 	case backup.S3BackupAdapter:
 		adapter, err = data.NewS3Backup()
+	case backup.IncrementalBackupAdapter:
+		adapter, err = data.NewIncrementalBackup()
 	default:
 		err = errors.New(fmt.Sprintf("unknown backup adapter [%s] provided", data.Adapter))
 		return
@@ -47,13 +50,246 @@ func postServerBackup(c *gin.Context) {
 	c.Status(http.StatusAccepted)
 }
 
+// The details required to locate a backup that is being read by wings. These are provided
+// in the body of restoration requests, or in the query string when listing the contents of
+// a backup. The encryption key is never read from the query string since it would end up in
+// access logs, it must be sent in the body or the X-Backup-Encryption-Key header instead.
+type backupLocation struct {
+	Adapter       string `json:"adapter" form:"adapter"`
+	DownloadUrl   string `json:"download_url" form:"download_url"`
+	EncryptionKey string `json:"encryption_key" form:"-"`
+}
+
+// Returns the backup adapter for the location. For local backups the archive is read directly
+// from the backup directory, for S3 backups the archive is streamed from the presigned download
+// URL. If the backup cannot be used the request is aborted and nil is returned.
+func (l *backupLocation) adapter(c *gin.Context, s *server.Server, requireDownload bool) backup.BackupInterface {
+	notFound := func(err error) {
+		if errors.Is(err, os.ErrNotExist) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "The requested backup was not found on this server.",
+			})
+			return
+		}
+
+		TrackedServerError(err, s).AbortWithServerError(c)
+	}
+
+	switch l.Adapter {
+	case backup.LocalBackupAdapter:
+		b, _, err := backup.LocateLocal(c.Param("backup"))
+		if err != nil {
+			notFound(err)
+			return nil
+		}
+
+		b.EncryptionKey = l.EncryptionKey
+		return b
+	case backup.IncrementalBackupAdapter:
+		b, _, err := backup.LocateIncremental(c.Param("backup"))
+		if err != nil {
+			notFound(err)
+			return nil
+		}
+
+		return b
+	case backup.S3BackupAdapter:
+		if requireDownload && l.DownloadUrl == "" {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": "A presigned download URL must be provided when restoring a backup using the [s3] adapter.",
+			})
+			return nil
+		}
+
+		return &backup.S3Backup{
+			Backup:       backup.Backup{Uuid: c.Param("backup"), EncryptionKey: l.EncryptionKey},
+			PresignedUrl: l.DownloadUrl,
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+		"error": fmt.Sprintf("Unknown backup adapter [%s] provided.", l.Adapter),
+	})
+
+	return nil
+}
+
+// Restores a backup to a server. The restoration itself happens in the background, the panel
+// is notified once it has completed.
+func postServerRestoreBackup(c *gin.Context) {
+	s := GetServer(c.Param("server"))
+
+	var data struct {
+		backupLocation
+		TruncateDirectory bool `json:"truncate_directory"`
+	}
+	// BindJSON sends 400 if the request fails, all we need to do is return
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if !s.StartRestoring() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "A backup is already being restored to this server.",
+		})
+		return
+	}
+
+	adapter := data.adapter(c, s, true)
+	if adapter == nil {
+		s.SetRestoring(false)
+		return
+	}
+
+	go func(b backup.BackupInterface, serv *server.Server, truncate bool) {
+		if err := serv.RestoreBackup(b, truncate); err != nil {
+			serv.Log().WithField("error", err).Error("failed to restore backup to server")
+		}
+	}(adapter, s, data.TruncateDirectory)
+
+	c.Status(http.StatusAccepted)
+}
+
+// Restores only the selected files and directories from a backup to a server. Unlike a full
+// restoration the server is not stopped, and the existing files are left in place.
+func postServerRestoreBackupFiles(c *gin.Context) {
+	s := GetServer(c.Param("server"))
+
+	var data struct {
+		backupLocation
+		Files []string `json:"files"`
+	}
+	// BindJSON sends 400 if the request fails, all we need to do is return
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	if len(data.Files) == 0 {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "No files were selected to be restored from the backup.",
+		})
+		return
+	}
+
+	if !s.StartRestoring() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "A backup is already being restored to this server.",
+		})
+		return
+	}
+
+	adapter := data.adapter(c, s, true)
+	if adapter == nil {
+		s.SetRestoring(false)
+		return
+	}
+
+	go func(b backup.BackupInterface, serv *server.Server, files []string) {
+		if err := serv.RestoreBackupFiles(b, files); err != nil {
+			serv.Log().WithField("error", err).Error("failed to restore files from backup to server")
+		}
+	}(adapter, s, data.Files)
+
+	c.Status(http.StatusAccepted)
+}
+
+// Verifies the integrity of a backup by reading the entire archive. The verification happens
+// in the background and the result is reported to the panel once it has completed.
+func postServerVerifyBackup(c *gin.Context) {
+	s := GetServer(c.Param("server"))
+
+	var data backupLocation
+	// BindJSON sends 400 if the request fails, all we need to do is return
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	adapter := data.adapter(c, s, true)
+	if adapter == nil {
+		return
+	}
+
+	go func(b backup.BackupInterface, serv *server.Server) {
+		if err := backup.VerifyAndNotify(b); err != nil {
+			serv.Log().WithField("backup", b.Identifier()).WithField("error", err).Warn("backup failed integrity verification")
+		}
+	}(adapter, s)
+
+	c.Status(http.StatusAccepted)
+}
+
+// Returns every file contained within a backup. The location of the backup is read from the
+// query string, and the encryption key for the backup from the X-Backup-Encryption-Key header.
+func getServerBackupContents(c *gin.Context) {
+	var data backupLocation
+	if err := c.BindQuery(&data); err != nil {
+		return
+	}
+	data.EncryptionKey = c.GetHeader("X-Backup-Encryption-Key")
+
+	serverBackupContents(c, data)
+}
+
+// Returns every file contained within a backup, using the location and encryption key for the
+// backup sent in the body of the request.
+func postServerBackupContents(c *gin.Context) {
+	var data backupLocation
+	// BindJSON sends 400 if the request fails, all we need to do is return
+	if err := c.BindJSON(&data); err != nil {
+		return
+	}
+
+	serverBackupContents(c, data)
+}
+
+// Responds with every file contained within a backup. For S3 backups that were not generated
+// on this node the entire archive is streamed from the bucket to build the listing.
+func serverBackupContents(c *gin.Context, data backupLocation) {
+	s := GetServer(c.Param("server"))
+
+	adapter := data.adapter(c, s, false)
+	if adapter == nil {
+		return
+	}
+
+	m, err := adapter.Contents()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "The requested backup was not found on this server.",
+			})
+			return
+		}
+
+		// S3 backups that were not generated on this node can only be listed by reading the
+		// archive from the bucket.
+		if errors.Is(err, backup.ErrMissingDownloadUrl) {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": "A presigned download URL must be provided to list the contents of a backup using the [s3] adapter that was not generated on this node.",
+			})
+			return
+		}
+
+		TrackedServerError(err, s).AbortWithServerError(c)
+		return
+	}
+
+	// The chunks used by incremental backups are an internal detail, don't send them
+	// back in the response.
+	for i := range m.Files {
+		m.Files[i].Chunks = nil
+	}
+
+	c.JSON(http.StatusOK, m)
+}
+
 // Deletes a local backup of a server. If the backup is not found on the machine just return
 // a 404 error. The service calling this endpoint can make its own decisions as to how it wants
 // to handle that response.
 func deleteServerBackup(c *gin.Context) {
 	s := GetServer(c.Param("server"))
 
-	b, _, err := backup.LocateLocal(c.Param("backup"))
+	b, err := locateStoredBackup(c.Param("backup"))
 	if err != nil {
 		// Just return from the function at this point if the backup was not located.
 		if errors.Is(err, os.ErrNotExist) {
@@ -79,3 +315,44 @@ func deleteServerBackup(c *gin.Context) {
 
 	c.Status(http.StatusNoContent)
 }
+
+// Cancels a backup that is currently queued or being generated for a server. The backup
+// is reported to the panel as having failed once it has stopped.
+func deleteServerBackupJob(c *gin.Context) {
+	s := GetServer(c.Param("server"))
+
+	if !s.CancelBackup(c.Param("backup")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "There is no backup job running for the requested backup.",
+		})
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// Locates a backup that is stored on this machine, which is either a standard local backup
+// archive, the manifest for an incremental backup, or the manifest kept for an S3 backup that
+// was generated on this node.
+func locateStoredBackup(uuid string) (backup.BackupInterface, error) {
+	b, _, err := backup.LocateLocal(uuid)
+	if err == nil {
+		return b, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ib, _, err := backup.LocateIncremental(uuid)
+	if err == nil {
+		return ib, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	sb, err := backup.LocateS3(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return sb, nil
+}
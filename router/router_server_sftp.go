@@ -0,0 +1,30 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pterodactyl/wings/sftp"
+	"net/http"
+)
+
+// Returns every user that is currently connected to the server over SFTP.
+func getServerSftpSessions(c *gin.Context) {
+	s := GetServer(c.Param("server"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sftp.Sessions(s.Id()),
+	})
+}
+
+// Disconnects a single SFTP session from the server.
+func deleteServerSftpSession(c *gin.Context) {
+	s := GetServer(c.Param("server"))
+
+	if !sftp.Disconnect(s.Id(), c.Param("session")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "The requested SFTP session does not exist for this server.",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,42 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pterodactyl/wings/sftp"
+	"net/http"
+)
+
+// Returns every IP address and username that is currently blocked from logging in to the
+// SFTP server after too many failed attempts.
+func getSftpBans(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"bans": sftp.Bans(),
+	})
+}
+
+// Clears every ban and failed login attempt recorded by the SFTP server.
+func deleteSftpBans(c *gin.Context) {
+	sftp.ClearBans()
+
+	c.Status(http.StatusNoContent)
+}
+
+// Clears the ban and failed login attempts for a single IP address or username.
+func deleteSftpBan(c *gin.Context) {
+	t := c.Param("type")
+	if t != sftp.BanTypeIp && t != sftp.BanTypeUsername {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "The ban type must be either \"ip\" or \"username\".",
+		})
+		return
+	}
+
+	if !sftp.ClearBan(t, c.Param("value")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "There are no failed login attempts recorded for that value.",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
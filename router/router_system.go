@@ -103,5 +103,9 @@ func postUpdateConfiguration(c *gin.Context) {
 		return
 	}
 
+	// Apply any changes to the bandwidth limits, including to transfers and downloads that
+	// are already running.
+	updateRateLimits()
+
 	c.Status(http.StatusNoContent)
 }
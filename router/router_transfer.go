@@ -1,7 +1,6 @@
 package router
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
@@ -12,19 +11,24 @@ import (
 	"github.com/pkg/errors"
 	"github.com/pterodactyl/wings/api"
 	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/environment"
 	"github.com/pterodactyl/wings/installer"
 	"github.com/pterodactyl/wings/router/tokens"
 	"github.com/pterodactyl/wings/server"
+	"github.com/pterodactyl/wings/server/backup"
+	"github.com/pterodactyl/wings/system"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func getServerArchive(c *gin.Context) {
+// Checks that the request contains a valid transfer token for the server, aborting the request
+// and returning false if it does not.
+func checkTransferToken(c *gin.Context) bool {
 	auth := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
 
 	if len(auth) != 2 || auth[0] != "Bearer" {
@@ -32,24 +36,45 @@ func getServerArchive(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 			"error": "The required authorization heads were not present in the request.",
 		})
-		return
+		return false
 	}
 
 	token := tokens.TransferPayload{}
 	if err := tokens.ParseToken([]byte(auth[1]), &token); err != nil {
 		TrackedError(err).AbortWithServerError(c)
-		return
+		return false
 	}
 
 	if token.Subject != c.Param("server") {
 		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 			"error": "( .. •˘___˘• .. )",
 		})
+		return false
+	}
+
+	return true
+}
+
+func getServerArchive(c *gin.Context) {
+	if !checkTransferToken(c) {
 		return
 	}
 
 	s := GetServer(c.Param("server"))
 
+	if c.Query("stream") == "true" {
+		// The final phase stops the server, so it must not be triggered by a GET request.
+		if c.Query("phase") == transferPhaseFinal {
+			c.AbortWithStatusJSON(http.StatusMethodNotAllowed, gin.H{
+				"error": "The final phase of a transfer must be requested using a POST request.",
+			})
+			return
+		}
+
+		streamServerArchive(c, s, c.Query("phase"))
+		return
+	}
+
 	st, err := s.Archiver.Stat()
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -83,11 +108,166 @@ func getServerArchive(c *gin.Context) {
 
 	c.Header("X-Checksum", checksum)
 	c.Header("X-Mime-Type", st.Mimetype)
-	c.Header("Content-Length", strconv.Itoa(int(st.Info.Size())))
 	c.Header("Content-Disposition", "attachment; filename="+s.Archiver.Name())
 	c.Header("Content-Type", "application/octet-stream")
 
-	bufio.NewReader(file).WriteTo(c.Writer)
+	p := newTransferProgress(s, transferOutgoing, st.Info.Size())
+
+	m := transferLimits.Acquire()
+	defer m.Release()
+
+	// Serve the archive using range requests, this allows the receiving node to download it in
+	// chunks and resume from where it left off if the connection is interrupted.
+	w := &rateLimitedResponseWriter{ResponseWriter: c.Writer, w: m.Writer(c.Writer)}
+	http.ServeContent(w, c.Request, s.Archiver.Name(), st.Info.ModTime(), &transferProgressFile{File: file, progress: p})
+
+	p.flush()
+}
+
+// Stops the server and streams the files that have changed since the pre-sync phase of a
+// transfer directly into the response.
+func postServerArchiveFinal(c *gin.Context) {
+	if !checkTransferToken(c) {
+		return
+	}
+
+	streamServerArchive(c, GetServer(c.Param("server")), transferPhaseFinal)
+}
+
+// Streams an archive of the server directly into the response, without an archive ever being
+// written to the disk. Since the size and checksum of the archive are not known until all of it
+// has been written, the checksum is sent as a trailer once the archive is complete. If anything
+// goes wrong the connection is closed without sending the trailer, which the receiving node
+// treats as a failed transfer.
+//
+// During a two-phase transfer the pre-sync phase sends every file while the server is still
+// running, and saves a snapshot of what was sent. The final phase then stops the server and
+// only sends the files that have changed since that snapshot.
+func streamServerArchive(c *gin.Context, s *server.Server, phase string) {
+	var included *backup.IncludedFiles
+	var err error
+	if phase == transferPhaseFinal {
+		if s.GetState() != environment.ProcessOfflineState {
+			s.Log().Info("stopping server instance for final sync of transfer")
+			if err := s.HandlePowerAction(server.PowerActionStop, 30); err != nil {
+				TrackedServerError(err, s).SetMessage("failed to stop server for final sync").AbortWithServerError(c)
+				return
+			}
+		}
+
+		included, _, err = s.Archiver.Delta()
+	} else {
+		included, err = s.Filesystem().GetIncludedFiles(s.Filesystem().Path(), nil)
+	}
+
+	if err != nil {
+		TrackedServerError(err, s).SetMessage("failed to get files for archive").AbortWithServerError(c)
+		return
+	}
+
+	a := &backup.Archive{
+		TrimPrefix: s.Filesystem().Path(),
+		Files:      included,
+		Limiter:    system.NewRateLimiter(0),
+		Progress:   &backup.Progress{},
+	}
+
+	// The size of the archive is not known ahead of time, so progress is tracked using the
+	// total size of the files being sent instead. This is also sent to the receiving node so
+	// that it can report its own progress.
+	a.Progress.Track(included)
+	_, total := a.Progress.Bytes()
+	p := newTransferProgress(s, transferOutgoing, total)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n, _ := a.Progress.Bytes()
+				p.set(n)
+			}
+		}
+	}()
+
+	c.Header("X-Transfer-Size", strconv.FormatInt(total, 10))
+	c.Header("Trailer", "X-Checksum")
+	c.Header("X-Mime-Type", "application/tar+gzip")
+	c.Header("Content-Disposition", "attachment; filename="+s.Archiver.Name())
+	c.Header("Content-Type", "application/octet-stream")
+	c.Status(http.StatusOK)
+
+	m := transferLimits.Acquire()
+	defer m.Release()
+
+	h := sha256.New()
+	err = a.Stream(c.Request.Context(), io.MultiWriter(m.Writer(c.Writer), h))
+
+	n, _ := a.Progress.Bytes()
+	p.set(n)
+	p.flush()
+
+	if err != nil {
+		s.Log().WithField("error", err).Error("failed to stream server archive for transfer")
+		return
+	}
+
+	if phase == transferPhasePresync {
+		if err := s.Archiver.SaveSnapshot(a.Contents()); err != nil {
+			s.Log().WithField("error", err).Error("failed to save snapshot of files sent during transfer pre-sync")
+			return
+		}
+	}
+
+	c.Writer.Header().Set("X-Checksum", hex.EncodeToString(h.Sum(nil)))
+}
+
+// Returns the files that were sent during the pre-sync phase of a transfer but have since been
+// deleted, so that the receiving node can remove them after the final sync.
+func getServerArchiveDeletedFiles(c *gin.Context) {
+	if !checkTransferToken(c) {
+		return
+	}
+
+	s := GetServer(c.Param("server"))
+
+	_, deleted, err := s.Archiver.Delta()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "There is no pre-sync snapshot for this server.",
+			})
+			return
+		}
+
+		TrackedServerError(err, s).AbortWithServerError(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": deleted})
+}
+
+// Removes the snapshot saved during the pre-sync phase of a transfer. This is called by the
+// receiving node once the transfer has finished, or has failed.
+func deleteServerArchiveSnapshot(c *gin.Context) {
+	if !checkTransferToken(c) {
+		return
+	}
+
+	s := GetServer(c.Param("server"))
+
+	if err := s.Archiver.RemoveSnapshot(); err != nil {
+		TrackedServerError(err, s).AbortWithServerError(c)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
 
 func postServerArchive(c *gin.Context) {
@@ -120,196 +300,311 @@ func postServerArchive(c *gin.Context) {
 	c.Status(http.StatusAccepted)
 }
 
+// The modes that a server can be transferred to this node using. In the archive mode the source
+// node creates an archive of the server which is downloaded in chunks and verified before it is
+// extracted. In the stream mode the source node writes the archive directly into the response
+// and the files are extracted as they are received, so no archive is stored on either node.
+//
+// The presync mode streams the files in two phases so that the server only needs to be offline
+// for the second, much shorter, phase. The first phase sends every file while the server is still
+// running, then the server is stopped and only the files that changed since are sent.
+const (
+	transferModeArchive = "archive"
+	transferModeStream  = "stream"
+	transferModePresync = "presync"
+)
+
+// The phases of a presync transfer.
+const (
+	transferPhasePresync = "presync"
+	transferPhaseFinal   = "final"
+)
+
 func postTransfer(c *gin.Context) {
 	buf := bytes.Buffer{}
 	buf.ReadFrom(c.Request.Body)
 
-	go func(data []byte) {
-		serverID, _ := jsonparser.GetString(data, "server_id")
-		url, _ := jsonparser.GetString(data, "url")
-		token, _ := jsonparser.GetString(data, "token")
+	data := buf.Bytes()
+	serverID, _ := jsonparser.GetString(data, "server_id")
+	url, _ := jsonparser.GetString(data, "url")
+	token, _ := jsonparser.GetString(data, "token")
 
-		l := log.WithField("server", serverID)
-		// Create an http client with no timeout.
-		client := &http.Client{Timeout: 0}
+	mode, _ := jsonparser.GetString(data, "mode")
+	if mode == "" {
+		mode = transferModeArchive
+	}
 
-		hasError := true
-		defer func() {
-			if !hasError {
-				return
-			}
+	if mode != transferModeArchive && mode != transferModeStream && mode != transferModePresync {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "The transfer mode provided is not supported.",
+		})
+		return
+	}
 
-			l.Info("server transfer failed, notifying panel")
-			err := api.New().SendTransferFailure(serverID)
-			if err != nil {
-				if !api.IsRequestError(err) {
-					l.WithField("error", err).Error("failed to notify panel with transfer failure")
-					return
-				}
+	serverData, _, _, _ := jsonparser.Get(data, "server")
+
+	t := &transferState{ServerID: serverID, Url: url, Token: token, Mode: mode, Server: serverData}
+	// If this transfer was previously interrupted pick up from where it left off, using the
+	// token and server details from this request.
+	if st, err := loadTransferState(serverID); err != nil {
+		log.WithField("server", serverID).WithField("error", err).Warn("failed to load saved transfer state")
+	} else if st != nil && st.Url == url && st.Mode == mode {
+		st.Token = token
+		st.Server = serverData
+		t = st
+	}
 
-				l.WithField("error", err.Error()).Error("received error response from panel while notifying of transfer failure")
-				return
-			}
+	if serverExists(serverID) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "The server being transferred already exists on this node.",
+		})
+		return
+	}
 
-			l.Debug("notified panel of transfer failure")
-		}()
+	if !trackTransfer(serverID) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "A transfer is already in progress for this server.",
+		})
+		return
+	}
 
-		// Make a new GET request to the URL the panel gave us.
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.WithField("error", errors.WithStack(err)).Error("failed to create http request for archive transfer")
-			return
-		}
+	go func(t *transferState) {
+		defer untrackTransfer(t.ServerID)
 
-		// Add the authorization header.
-		req.Header.Set("Authorization", token)
+		runTransfer(t)
+	}(t)
 
-		// Execute the http request.
-		res, err := client.Do(req)
-		if err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to send archive http request")
-			return
+	c.Status(http.StatusAccepted)
+}
+
+// Resumes every incoming transfer that was interrupted by wings being stopped. This should
+// be called once when wings boots, after the servers have been loaded. A new token for each
+// transfer is requested from the panel before it is resumed.
+func ResumeTransfers() {
+	matches, err := filepath.Glob(filepath.Join(config.Get().System.ArchiveDirectory, "*.transfer.json"))
+	if err != nil {
+		log.WithField("error", err).Error("failed to locate interrupted server transfers")
+		return
+	}
+
+	for _, p := range matches {
+		t, err := loadTransferState(strings.TrimSuffix(filepath.Base(p), ".transfer.json"))
+		if err != nil || t == nil {
+			log.WithField("path", p).WithField("error", err).Warn("failed to load saved transfer state")
+			continue
 		}
-		defer res.Body.Close()
 
-		// Handle non-200 status codes.
-		if res.StatusCode != 200 {
-			_, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				l.WithField("error", errors.WithStack(err)).WithField("status", res.StatusCode).Error("failed read transfer response body")
+		if !trackTransfer(t.ServerID) {
+			continue
+		}
 
-				return
-			}
+		log.WithField("server", t.ServerID).Info("resuming interrupted server transfer")
 
-			l.WithField("error", errors.WithStack(err)).WithField("status", res.StatusCode).Error("failed to request server archive")
+		go func(t *transferState) {
+			defer untrackTransfer(t.ServerID)
 
+			runTransfer(t)
+		}(t)
+	}
+}
+
+// Creates the server for an incoming transfer on this node, and then receives the files for it
+// from the source node using the mode requested by the panel. The panel is notified of the result
+// of the transfer, and if it failed everything created for the server on this node is removed.
+func runTransfer(t *transferState) {
+	serverID := t.ServerID
+	archivePath := transferArchivePath(serverID)
+
+	// Transfers that were saved before the mode was recorded always used an archive.
+	if t.Mode == "" {
+		t.Mode = transferModeArchive
+	}
+
+	l := log.WithField("server", serverID)
+
+	// Never replace a server that already exists on this node. The archive for a transfer is
+	// stored at the same path as the archive of an existing server, so nothing is cleaned up
+	// when the transfer is refused.
+	exists := serverExists(serverID)
+
+	var s *server.Server
+	hasError := true
+	defer func() {
+		if !hasError {
 			return
 		}
 
-		// Get the path to the archive.
-		archivePath := filepath.Join(config.Get().System.ArchiveDirectory, serverID+".tar.gz")
-
-		// Check if the archive already exists and delete it if it does.
-		_, err = os.Stat(archivePath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				l.WithField("error", errors.WithStack(err)).Error("failed to stat archive file")
-				return
-			}
-		} else {
-			if err := os.Remove(archivePath); err != nil {
-				l.WithField("error", errors.WithStack(err)).Warn("failed to remove old archive file")
+		// Once the panel has been notified of the failure the transfer is never resumed, so
+		// there is no reason to keep anything that was downloaded.
+		if err := t.remove(); err != nil {
+			l.WithField("error", err).Warn("failed to remove transfer state")
+		}
 
-				return
+		if !exists {
+			if err := os.Remove(archivePath); err != nil && !os.IsNotExist(err) {
+				l.WithField("error", errors.WithStack(err)).Warn("failed to remove archive file")
 			}
 		}
 
-		// Create the file.
-		file, err := os.Create(archivePath)
-		if err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to open archive on disk")
-
-			return
+		if s != nil {
+			cleanupFailedTransfer(l, s)
 		}
 
-		// Copy the file.
-		buf := make([]byte, 1024*4)
-		_, err = io.CopyBuffer(file, res.Body, buf)
+		l.Info("server transfer failed, notifying panel")
+		err := api.New().SendTransferFailure(serverID)
 		if err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to copy archive file to disk")
+			if !api.IsRequestError(err) {
+				l.WithField("error", err).Error("failed to notify panel with transfer failure")
+				return
+			}
 
+			l.WithField("error", err.Error()).Error("received error response from panel while notifying of transfer failure")
 			return
 		}
 
-		// Close the file so it can be opened to verify the checksum.
-		if err := file.Close(); err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to close archive file")
+		l.Debug("notified panel of transfer failure")
+	}()
 
-			return
-		}
+	if exists {
+		l.Error("refusing to transfer a server that already exists on this node")
+		return
+	}
+
+	t.limiter = transferLimits.Acquire()
+	defer t.limiter.Release()
 
-		l.WithField("server", serverID).Debug("server archive downloaded, computing checksum...")
+	// Save the transfer before doing anything so that it can be resumed if wings is restarted.
+	if err := t.save(); err != nil {
+		l.WithField("error", err).Error("failed to save transfer state")
+		return
+	}
 
-		// Open the archive file for computing a checksum.
-		file, err = os.Open(archivePath)
+	// The token is not saved with the transfer, so a new one is needed when it is resumed.
+	if t.Token == "" {
+		token, err := api.New().GetTransferToken(serverID)
 		if err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to open archive on disk")
+			l.WithField("error", err).Error("failed to get a new token to resume the transfer")
 			return
 		}
 
-		// Compute the sha256 checksum of the file.
-		hash := sha256.New()
-		buf = make([]byte, 1024*4)
-		if _, err := io.CopyBuffer(hash, file, buf); err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to copy archive file for checksum verification")
-			return
-		}
+		t.Token = token
+	}
 
-		// Verify the two checksums.
-		if hex.EncodeToString(hash.Sum(nil)) != res.Header.Get("X-Checksum") {
-			l.Error("checksum verification failed for archive")
-			return
-		}
+	if len(t.Server) == 0 || t.Server[0] != '{' {
+		l.Error("invalid server data passed in request")
+		return
+	}
 
-		// Close the file.
-		if err := file.Close(); err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to close archive file after calculating checksum")
+	// Create a new server installer (note this does not execute the install script)
+	i, err := installer.New(t.Server)
+	if err != nil {
+		l.WithField("error", errors.WithStack(err)).Error("failed to validate received server data")
+		return
+	}
+
+	// When the archive is being downloaded it is verified before the server is created, which
+	// avoids creating a server only to find out that it cannot be extracted. The server is not
+	// in the collection yet, so the progress is not sent to any websocket listeners until then.
+	p := newTransferProgress(i.Server(), transferIncoming, 0)
+	if t.Mode == transferModeArchive {
+		if err := t.download(l, p); err != nil {
+			l.WithField("error", err).Error("failed to download server archive")
 			return
 		}
 
 		l.Info("server archive transfer was successful")
+	}
 
-		// Get the server data from the request.
-		serverData, t, _, _ := jsonparser.Get(data, "server")
-		if t != jsonparser.Object {
-			l.Error("invalid server data passed in request")
-			return
-		}
+	// Add the server to the collection. For the other modes this is done before any files are
+	// received so that the progress of the transfer can be sent to websocket listeners.
+	s = i.Server()
+	server.GetServers().Add(s)
 
-		// Create a new server installer (note this does not execute the install script)
-		i, err := installer.New(serverData)
-		if err != nil {
-			l.WithField("error", errors.WithStack(err)).Error("failed to validate received server data")
+	// Create the server's environment (note this does not execute the install script)
+	if err := s.CreateEnvironment(); err != nil {
+		l.WithField("error", err).Error("failed to create server environment")
+		return
+	}
+
+	switch t.Mode {
+	case transferModeStream:
+		if err := t.stream(l, s, "", p); err != nil {
+			l.WithField("error", err).Error("failed to stream server files")
 			return
 		}
 
-		// Add the server to the collection.
-		server.GetServers().Add(i.Server())
-
-		// Create the server's environment (note this does not execute the install script)
-		if err := i.Server().CreateEnvironment(); err != nil {
-			l.WithField("error", err).Error("failed to create server environment")
+		l.Info("server files were streamed successfully")
+	case transferModePresync:
+		if err := t.presync(l, s, p); err != nil {
+			l.WithField("error", err).Error("failed to sync server files")
 			return
 		}
 
+		l.Info("server files were synced successfully")
+	default:
 		// Un-archive the archive. That sounds weird..
-		if err := archiver.NewTarGz().Unarchive(archivePath, i.Server().Filesystem().Path()); err != nil {
+		if err := archiver.NewTarGz().Unarchive(archivePath, s.Filesystem().Path()); err != nil {
 			l.WithField("error", errors.WithStack(err)).Error("failed to extract server archive")
 			return
 		}
+	}
 
-		// We mark the process as being successful here as if we fail to send a transfer success,
-		// then a transfer failure won't probably be successful either.
-		//
-		// It may be useful to retry sending the transfer success every so often just in case of a small
-		// hiccup or the fix of whatever error causing the success request to fail.
-		hasError = false
+	p.flush()
 
-		// Notify the panel that the transfer succeeded.
-		err = api.New().SendTransferSuccess(serverID)
-		if err != nil {
-			if !api.IsRequestError(err) {
-				l.WithField("error", errors.WithStack(err)).Error("failed to notify panel of transfer success")
-				return
-			}
+	// The transfer has completed on this end, so there is nothing left to resume.
+	if err := t.remove(); err != nil {
+		l.WithField("error", err).Warn("failed to remove transfer state")
+	}
 
-			l.WithField("error", err.Error()).Error("panel responded with error after transfer success")
+	// We mark the process as being successful here as if we fail to send a transfer success,
+	// then a transfer failure won't probably be successful either.
+	//
+	// It may be useful to retry sending the transfer success every so often just in case of a small
+	// hiccup or the fix of whatever error causing the success request to fail.
+	hasError = false
 
+	// Notify the panel that the transfer succeeded.
+	err = api.New().SendTransferSuccess(serverID)
+	if err != nil {
+		if !api.IsRequestError(err) {
+			l.WithField("error", errors.WithStack(err)).Error("failed to notify panel of transfer success")
 			return
 		}
 
-		l.Info("successfully notified panel of transfer success")
-	}(buf.Bytes())
+		l.WithField("error", err.Error()).Error("panel responded with error after transfer success")
 
-	c.Status(http.StatusAccepted)
+		return
+	}
+
+	l.Info("successfully notified panel of transfer success")
+}
+
+// Determines if a server with the given UUID already exists on this node.
+func serverExists(uuid string) bool {
+	return server.GetServers().Find(func(s *server.Server) bool {
+		return s.Id() == uuid
+	}) != nil
+}
+
+// Removes everything that was created on this node for a server that failed to transfer. The
+// environment, data directory and the server itself are removed, so that a failed transfer does
+// not leave a half created server behind on the node.
+func cleanupFailedTransfer(l *log.Entry, s *server.Server) {
+	l.Info("removing partially transferred server from node")
+
+	s.Events().Destroy()
+	s.Throttler().StopTimer()
+	s.Websockets().CancelAll()
+
+	if err := s.Environment.Destroy(); err != nil {
+		l.WithField("error", err).Warn("failed to destroy environment for failed transfer")
+	}
+
+	if err := os.RemoveAll(s.Filesystem().Path()); err != nil {
+		l.WithField("error", errors.WithStack(err)).Warn("failed to remove server files for failed transfer")
+	}
+
+	server.GetServers().Remove(func(s2 *server.Server) bool {
+		return s2.Id() == s.Id()
+	})
 }
@@ -0,0 +1,652 @@
+package router
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/server"
+	"github.com/pterodactyl/wings/server/backup"
+	"github.com/pterodactyl/wings/server/filesystem"
+	"github.com/pterodactyl/wings/system"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The size of each chunk of the archive requested from the source node during a transfer.
+const transferChunkSize = 64 << 20
+
+// The number of times a single chunk is attempted before the transfer is failed.
+const transferChunkAttempts = 10
+
+// The servers that are currently being transferred to this node, used to prevent the same
+// transfer from being run twice at the same time.
+var transfers = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// Marks a transfer as running for the server, returns false if one is already running.
+func trackTransfer(serverID string) bool {
+	transfers.Lock()
+	defer transfers.Unlock()
+
+	if transfers.m[serverID] {
+		return false
+	}
+	transfers.m[serverID] = true
+
+	return true
+}
+
+func untrackTransfer(serverID string) {
+	transfers.Lock()
+	delete(transfers.m, serverID)
+	transfers.Unlock()
+}
+
+// An error returned while downloading a chunk that cannot be fixed by trying again, such as
+// the source node rejecting the transfer token.
+type permanentTransferError struct {
+	error
+}
+
+// The state of an archive being received from another node during a transfer. This is saved
+// to the disk after every chunk so that the transfer can be resumed from the last chunk that
+// was completely written if wings is restarted, rather than starting over.
+type transferState struct {
+	ServerID string `json:"server_id"`
+	Url      string `json:"url"`
+	Mode     string `json:"mode"`
+
+	// The token used to authenticate with the source node. This is never saved to the disk, a
+	// new token is requested from the panel when an interrupted transfer is resumed.
+	Token string `json:"-"`
+
+	// The phase of a presync transfer that is currently being run.
+	Phase string `json:"phase"`
+
+	// The checksum and size of the archive as reported by the source node.
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+
+	// The number of bytes of the archive that have been written and synced to the disk, and
+	// the state of the hash for those bytes. Keeping the hash state allows the checksum to be
+	// verified once the download completes without reading the whole archive again.
+	Offset int64  `json:"offset"`
+	Hash   []byte `json:"hash"`
+
+	// The details of the server being transferred, as sent by the panel.
+	Server json.RawMessage `json:"server"`
+
+	// The bandwidth limit applied while receiving the files for the transfer.
+	limiter *system.RateLimitGroupMember
+}
+
+// Returns the path that the state of the transfer for a server is stored at.
+func transferStatePath(serverID string) string {
+	return filepath.Join(config.Get().System.ArchiveDirectory, serverID+".transfer.json")
+}
+
+// Returns the path that the archive for a transfer is downloaded to.
+func transferArchivePath(serverID string) string {
+	return filepath.Join(config.Get().System.ArchiveDirectory, serverID+".tar.gz")
+}
+
+// Returns the directory that streamed files are extracted to until the checksum of the stream
+// has been verified. This is kept outside of the data directory of the server so that the files
+// are never visible to the server, and do not count towards its disk usage twice.
+func transferStagingPath(serverID string) string {
+	return filepath.Join(config.Get().System.ArchiveDirectory, serverID)
+}
+
+// Loads the state of a transfer from the disk, returning nil if there is no saved state for
+// the server.
+func loadTransferState(serverID string) (*transferState, error) {
+	b, err := ioutil.ReadFile(transferStatePath(serverID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.WithStack(err)
+	}
+
+	var t transferState
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &t, nil
+}
+
+// Saves the state of the transfer to the disk. The state is written to a temporary file and
+// then moved into place so that a crash never leaves a partially written state behind.
+func (t *transferState) save() error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := transferStatePath(t.ServerID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, transferStatePath(t.ServerID)))
+}
+
+// Removes the saved state of the transfer.
+func (t *transferState) remove() error {
+	if err := os.Remove(transferStatePath(t.ServerID)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Downloads the archive for the transfer from the source node in chunks. Each chunk is tried
+// a number of times with an increasing delay between attempts. If the transfer has already
+// been partially downloaded it is resumed from the last chunk that was written.
+func (t *transferState) download(l *log.Entry, p *transferProgress) error {
+	f, err := os.OpenFile(transferArchivePath(t.ServerID), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if t.Offset > 0 {
+		st, err := f.Stat()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// If the archive on the disk is shorter than the saved offset or the hash state cannot
+		// be restored there is no way to resume the download, so start again from the beginning.
+		if st.Size() < t.Offset || h.(encoding.BinaryUnmarshaler).UnmarshalBinary(t.Hash) != nil {
+			l.Warn("saved transfer state does not match archive on disk, restarting download")
+
+			h.Reset()
+			t.Offset = 0
+		} else {
+			l.WithField("offset", t.Offset).Info("resuming download of server archive")
+		}
+	}
+
+	// Remove anything after the last chunk that was completely written, this would be left
+	// behind if wings was stopped part of the way through writing a chunk.
+	if err := f.Truncate(t.Offset); err != nil {
+		return errors.WithStack(err)
+	}
+
+	client := &http.Client{Timeout: 0}
+	for done := false; !done; {
+		for attempt := 1; ; attempt++ {
+			done, err = t.downloadChunk(client, f, h, p)
+			if err == nil {
+				break
+			}
+
+			var perr *permanentTransferError
+			if errors.As(err, &perr) || attempt >= transferChunkAttempts {
+				return err
+			}
+
+			wait := time.Second << uint(attempt-1)
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+
+			l.WithFields(log.Fields{"offset": t.Offset, "attempt": attempt, "error": err}).
+				Warn("failed to download chunk of server archive, retrying")
+
+			time.Sleep(wait)
+		}
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != t.Checksum {
+		return &permanentTransferError{errors.New("checksum verification failed for archive")}
+	}
+
+	return nil
+}
+
+// Requests the next chunk of the archive from the source node and appends it to the archive on
+// the disk. If the chunk cannot be completely written the archive and hash are rolled back to
+// the end of the previous chunk. Returns true once the entire archive has been downloaded.
+func (t *transferState) downloadChunk(client *http.Client, f *os.File, h hash.Hash, p *transferProgress) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, t.Url, nil)
+	if err != nil {
+		return false, &permanentTransferError{errors.WithStack(err)}
+	}
+
+	req.Header.Set("Authorization", t.Token)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", t.Offset, t.Offset+transferChunkSize-1))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The offset is at the end of the archive, which only happens when the archive is
+		// empty since the size is otherwise known before the last chunk is requested.
+		size, _ := parseContentRange(res.Header.Get("Content-Range"))
+		if size != t.Offset {
+			return false, &permanentTransferError{errors.New(fmt.Sprintf("source node rejected requested range of archive: %s", res.Status))}
+		}
+
+		t.Size = size
+		if t.Checksum == "" {
+			t.Checksum = res.Header.Get("X-Checksum")
+		}
+
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false, &permanentTransferError{errors.New(fmt.Sprintf("failed to request server archive: %s", res.Status))}
+	default:
+		return false, errors.New(fmt.Sprintf("failed to request server archive: %s", res.Status))
+	}
+
+	// If the archive on the source node has changed since the transfer started nothing that
+	// has been downloaded so far can be trusted.
+	checksum := res.Header.Get("X-Checksum")
+	if t.Checksum != "" && checksum != t.Checksum {
+		return false, &permanentTransferError{errors.New("server archive was modified on the source node during the transfer")}
+	}
+	t.Checksum = checksum
+
+	full := res.StatusCode == http.StatusOK
+	if full {
+		// The source node does not support range requests, so the entire archive is sent in
+		// this response and must be written from the very beginning.
+		if t.Offset != 0 {
+			if err := f.Truncate(0); err != nil {
+				return false, &permanentTransferError{errors.WithStack(err)}
+			}
+
+			h.Reset()
+			t.Offset = 0
+			t.Hash = nil
+		}
+		t.Size = res.ContentLength
+	} else if size, start := parseContentRange(res.Header.Get("Content-Range")); start != t.Offset {
+		return false, errors.New("source node responded with an unexpected range of the archive")
+	} else {
+		t.Size = size
+	}
+
+	if _, err := f.Seek(t.Offset, io.SeekStart); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	p.setTotal(t.Size)
+	p.set(t.Offset)
+
+	n, err := io.Copy(io.MultiWriter(f, h), p.reader(t.limiter.Reader(res.Body)))
+	if err == nil && res.ContentLength >= 0 && n != res.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		// Roll back to the end of the previous chunk so that the next attempt starts from a
+		// known good position.
+		h.Reset()
+		if t.Offset > 0 {
+			if uerr := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(t.Hash); uerr != nil {
+				return false, &permanentTransferError{errors.WithStack(uerr)}
+			}
+		}
+
+		if terr := f.Truncate(t.Offset); terr != nil {
+			return false, &permanentTransferError{errors.WithStack(terr)}
+		}
+		p.set(t.Offset)
+
+		return false, errors.WithStack(err)
+	}
+
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return false, &permanentTransferError{errors.WithStack(err)}
+	}
+
+	t.Offset += n
+	t.Hash = state
+	if err := t.save(); err != nil {
+		return false, &permanentTransferError{err}
+	}
+
+	return full || t.Offset >= t.Size, nil
+}
+
+// Streams the files for the transfer from the source node, extracting each one into the data
+// directory of the server as it is received. The checksum of the stream is sent by the source
+// node as a trailer once the archive is complete, so it can only be checked after every file
+// has been written. To avoid leaving the files from a corrupt stream behind they are extracted
+// to a staging directory, and only moved into place once the checksum has been verified. A
+// streamed transfer cannot be resumed, if it fails it must start over.
+//
+// If a phase is provided only the files for that phase of a presync transfer are sent.
+func (t *transferState) stream(l *log.Entry, s *server.Server, phase string, p *transferProgress) error {
+	u, err := url.Parse(t.Url)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	q := u.Query()
+	q.Set("stream", "true")
+	if phase != "" && phase != transferPhaseFinal {
+		q.Set("phase", phase)
+	}
+	u.RawQuery = q.Encode()
+
+	// The final phase stops the server on the source node, so it is requested using a POST.
+	method := http.MethodGet
+	if phase == transferPhaseFinal {
+		method = http.MethodPost
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/final"
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", t.Token)
+
+	res, err := (&http.Client{Timeout: 0}).Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("failed to request server archive stream: %s", res.Status))
+	}
+
+	// The source node sends the total size of the files in the archive, progress is tracked
+	// using the number of bytes that have been extracted.
+	total, _ := strconv.ParseInt(res.Header.Get("X-Transfer-Size"), 10, 64)
+	p.setTotal(total)
+	p.set(0)
+
+	staging := &transferStaging{
+		server: s,
+		dir:    transferStagingPath(s.Id()),
+		deltas: make(map[string]int64),
+	}
+
+	// Remove anything left behind by a previous attempt before starting, and make sure nothing
+	// is left behind if this attempt fails.
+	if err := os.RemoveAll(staging.dir); err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(staging.dir)
+
+	h := sha256.New()
+	body := io.TeeReader(t.limiter.Reader(res.Body), h)
+
+	err = backup.ExtractArchive(body, func(header *tar.Header, r io.Reader) error {
+		if !header.FileInfo().Mode().IsRegular() {
+			return nil
+		}
+
+		l.WithField("file", header.Name).Debug("extracting file from server archive stream")
+
+		return staging.add(header, p.reader(r))
+	})
+	if err != nil {
+		return err
+	}
+
+	// Read anything left in the body after the end of the archive, the trailer is only made
+	// available once the body has been read completely.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return errors.WithStack(err)
+	}
+
+	checksum := res.Trailer.Get("X-Checksum")
+	if checksum == "" {
+		return errors.New("source node did not send a checksum for the archive stream, it was likely interrupted")
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		return errors.New("checksum verification failed for archive stream")
+	}
+
+	return staging.commit()
+}
+
+// The files streamed from the source node that are waiting to be moved into the data directory
+// of a server.
+type transferStaging struct {
+	server *server.Server
+	dir    string
+
+	// The difference in size between each staged file and the existing file it replaces, and
+	// the total of those differences. The existing files only stop counting towards the disk
+	// usage of the server once the staged files have replaced them.
+	deltas map[string]int64
+	delta  int64
+}
+
+// Writes a file from the archive stream to the staging directory, returning an error if the
+// server does not have the disk space for the files staged so far to be moved into place.
+func (ts *transferStaging) add(header *tar.Header, r io.Reader) error {
+	name := filepath.Clean("/" + header.Name)
+
+	dst, err := ts.server.Filesystem().SafePath(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var current int64
+	if st, err := os.Stat(dst); err != nil {
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	} else if st.IsDir() {
+		return errors.WithStack(filesystem.ErrIsDirectory)
+	} else {
+		current = st.Size()
+	}
+
+	// A file may be sent more than once, in which case only the last copy is moved into place.
+	delta := header.Size - current
+	if err := ts.server.Filesystem().HasSpaceFor(ts.delta - ts.deltas[name] + delta); err != nil {
+		return err
+	}
+	ts.delta += delta - ts.deltas[name]
+	ts.deltas[name] = delta
+
+	p := filepath.Join(ts.dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(f.Close())
+}
+
+// Moves every staged file into place in the data directory of the server, replacing any
+// existing file with the same name.
+func (ts *transferStaging) commit() error {
+	return filepath.Walk(ts.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ts.dir, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return ts.server.Filesystem().ReplaceFile(rel, p)
+	})
+}
+
+// Runs a two-phase transfer. Every file is streamed from the source node while the server is
+// still running on it, then the source node stops the server and streams only the files that
+// have changed since. Finally any files deleted on the source node in the meantime are removed.
+//
+// Once the pre-sync has completed it is recorded in the transfer state, so that it is not run
+// again if wings is restarted during the final sync.
+func (t *transferState) presync(l *log.Entry, s *server.Server, p *transferProgress) error {
+	// Once this returns the transfer has either completed or failed, and a failed transfer is
+	// never resumed, so the snapshot on the source node is no longer needed either way.
+	defer func() {
+		if err := t.removeSnapshot(); err != nil {
+			l.WithField("error", err).Warn("failed to remove pre-sync snapshot from source node")
+		}
+	}()
+
+	if t.Phase != transferPhaseFinal {
+		if err := t.stream(l, s, transferPhasePresync, p); err != nil {
+			return err
+		}
+
+		t.Phase = transferPhaseFinal
+		if err := t.save(); err != nil {
+			return err
+		}
+	}
+
+	l.Info("pre-sync of server files completed, starting final sync")
+
+	if err := t.stream(l, s, transferPhaseFinal, p); err != nil {
+		return err
+	}
+
+	deleted, err := t.deletedFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range deleted {
+		if err := s.Filesystem().Delete(name); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// Asks the source node to remove the snapshot it saved during the pre-sync.
+func (t *transferState) removeSnapshot() error {
+	u, err := url.Parse(t.Url)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/snapshot"
+
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", t.Token)
+
+	res, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return errors.New(fmt.Sprintf("failed to remove snapshot from source node: %s", res.Status))
+	}
+
+	return nil
+}
+
+// Requests the files that were deleted on the source node since the pre-sync.
+func (t *transferState) deletedFiles() ([]string, error) {
+	u, err := url.Parse(t.Url)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/deleted"
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Authorization", t.Token)
+
+	res, err := (&http.Client{Timeout: time.Minute * 5}).Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("failed to request deleted files from source node: %s", res.Status))
+	}
+
+	var data struct {
+		Files []string `json:"files"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return data.Files, nil
+}
+
+// Parses a Content-Range header, returning the total size of the resource and the offset of
+// the first byte in the response. The start is -1 for unsatisfied ranges.
+func parseContentRange(v string) (size int64, start int64) {
+	v = strings.TrimPrefix(v, "bytes ")
+
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return -1, -1
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		size = -1
+	}
+
+	start = -1
+	if r := strings.SplitN(parts[0], "-", 2); len(r) == 2 {
+		if s, err := strconv.ParseInt(r[0], 10, 64); err == nil {
+			start = s
+		}
+	}
+
+	return size, start
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"github.com/pterodactyl/wings/server"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The directions that a server can be transferred in, relative to this node.
+const (
+	transferOutgoing = "outgoing"
+	transferIncoming = "incoming"
+)
+
+// Publishes the progress of a transfer to the websocket listeners for a server. Progress is
+// updated for every read or write, so events are only sent at most once a second.
+type transferProgress struct {
+	mu        sync.Mutex
+	s         *server.Server
+	direction string
+	bytes     int64
+	total     int64
+	last      time.Time
+}
+
+func newTransferProgress(s *server.Server, direction string, total int64) *transferProgress {
+	return &transferProgress{s: s, direction: direction, total: total}
+}
+
+// Sets the number of bytes that have been transferred.
+func (p *transferProgress) set(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytes = n
+	p.publish(false)
+}
+
+// Adds to the number of bytes that have been transferred.
+func (p *transferProgress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytes += n
+	p.publish(false)
+}
+
+// Sets the total number of bytes being transferred.
+func (p *transferProgress) setTotal(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.total = n
+}
+
+// Publishes the current progress, regardless of when the last event was sent.
+func (p *transferProgress) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.publish(true)
+}
+
+// Publishes the progress over the websocket. This must be called while holding the lock.
+func (p *transferProgress) publish(force bool) {
+	if !force && time.Since(p.last) < time.Second {
+		return
+	}
+	p.last = time.Now()
+
+	_ = p.s.Events().PublishJson(server.TransferProgressEvent, map[string]interface{}{
+		"direction": p.direction,
+		"bytes":     p.bytes,
+		"total":     p.total,
+	})
+}
+
+// Returns a reader that adds every byte read from it to the progress.
+func (p *transferProgress) reader(r io.Reader) io.Reader {
+	return &transferProgressReader{r: r, progress: p}
+}
+
+type transferProgressReader struct {
+	r        io.Reader
+	progress *transferProgress
+}
+
+func (r *transferProgressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.progress.add(int64(n))
+	}
+
+	return n, err
+}
+
+// A file that sets the progress to its current offset every time it is read from. This is used
+// when serving a range of an archive, where the position in the file is the number of bytes
+// that the receiving node has.
+type transferProgressFile struct {
+	*os.File
+	progress *transferProgress
+}
+
+func (f *transferProgressFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	if pos, serr := f.File.Seek(0, io.SeekCurrent); serr == nil {
+		f.progress.set(pos)
+	}
+
+	return n, err
+}
@@ -45,6 +45,12 @@ var e = []string{
 	server.InstallCompletedEvent,
 	server.DaemonMessageEvent,
 	server.BackupCompletedEvent,
+	server.BackupRestoreCompletedEvent,
+	server.BackupQueuedEvent,
+	server.BackupProgressEvent,
+	server.TransferProgressEvent,
+	server.SftpBlockedEvent,
+	server.SftpActivityEvent,
 }
 
 // Listens for different events happening on a server and sends them along
@@ -29,7 +29,10 @@ const (
 	PermissionSendPowerRestart = "control.restart"
 	PermissionReceiveErrors    = "admin.websocket.errors"
 	PermissionReceiveInstall   = "admin.websocket.install"
+	PermissionReceiveTransfer  = "admin.websocket.transfer"
 	PermissionReceiveBackups   = "backup.read"
+	PermissionReceiveSftp      = "admin.websocket.sftp"
+	PermissionReceiveActivity  = "activity.read"
 )
 
 type Handler struct {
@@ -118,6 +121,27 @@ func (h *Handler) Uuid() uuid.UUID {
 	return h.uuid
 }
 
+// Events that are only sent over the socket if the user has permission to view the backups
+// for a server.
+var backupEvents = []string{
+	server.BackupCompletedEvent,
+	server.BackupRestoreCompletedEvent,
+	server.BackupQueuedEvent,
+	server.BackupProgressEvent,
+}
+
+// Determines if the given event is one relating to server backups. Backup events are sent
+// with the UUID of the backup appended to them, so only the prefix is compared.
+func isBackupEvent(event string) bool {
+	for _, e := range backupEvents {
+		if strings.HasPrefix(event, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (h *Handler) SendJson(v *Message) error {
 	// Do not send JSON down the line if the JWT on the connection is not valid!
 	if err := h.TokenValid(); err != nil {
@@ -139,9 +163,31 @@ func (h *Handler) SendJson(v *Message) error {
 			}
 		}
 
+		// Transfers are only visible to administrators, so the progress of one is not sent
+		// to users without permission to see it.
+		if v.Event == server.TransferProgressEvent {
+			if !j.HasPermission(PermissionReceiveTransfer) {
+				return nil
+			}
+		}
+
+		// Blocked SFTP logins include the IP address of whoever was attempting to login, so
+		// they are only sent to users that are allowed to see them.
+		if v.Event == server.SftpBlockedEvent {
+			if !j.HasPermission(PermissionReceiveSftp) {
+				return nil
+			}
+		}
+
+		if v.Event == server.SftpActivityEvent {
+			if !j.HasPermission(PermissionReceiveActivity) {
+				return nil
+			}
+		}
+
 		// If the user does not have permission to see backup events, do not emit
 		// them over the socket.
-		if strings.HasPrefix(v.Event, server.BackupCompletedEvent) {
+		if isBackupEvent(v.Event) {
 			if !j.HasPermission(PermissionReceiveBackups) {
 				return nil
 			}
@@ -206,6 +252,7 @@ func (h *Handler) SendErrorJson(msg Message, err error, shouldLog ...bool) error
 	j := h.GetJwt()
 	expected := errors.Is(err, server.ErrSuspended) ||
 		errors.Is(err, server.ErrIsRunning) ||
+		errors.Is(err, server.ErrIsRestoring) ||
 		errors.Is(err, filesystem.ErrNotEnoughDiskSpace)
 
 	message := "an unexpected error was encountered while handling this request"
@@ -3,14 +3,17 @@ package server
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/mholt/archiver/v3"
 	"github.com/pkg/errors"
 	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/server/backup"
 	"github.com/pterodactyl/wings/server/filesystem"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // Archiver represents a Server Archiver.
@@ -102,10 +105,21 @@ func (a *Archiver) DeleteIfExists() error {
 		return errors.WithStack(err)
 	}
 
+	if err := os.Remove(a.checksumPath()); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
 	return nil
 }
 
-// Checksum computes a SHA256 checksum of the server's archive.
+// Returns the path to the file that the checksum of the archive is cached in.
+func (a *Archiver) checksumPath() string {
+	return a.Path() + ".sha256"
+}
+
+// Checksum computes a SHA256 checksum of the server's archive. The checksum is cached next to
+// the archive since it is requested for every chunk of the archive sent during a transfer, it
+// is only calculated again if the archive has been modified since.
 func (a *Archiver) Checksum() (string, error) {
 	file, err := os.Open(a.Path())
 	if err != nil {
@@ -113,6 +127,17 @@ func (a *Archiver) Checksum() (string, error) {
 	}
 	defer file.Close()
 
+	st, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if cst, err := os.Stat(a.checksumPath()); err == nil && !cst.ModTime().Before(st.ModTime()) {
+		if b, err := ioutil.ReadFile(a.checksumPath()); err == nil && len(b) == sha256.Size*2 {
+			return string(b), nil
+		}
+	}
+
 	hash := sha256.New()
 
 	buf := make([]byte, 1024*4)
@@ -120,5 +145,96 @@ func (a *Archiver) Checksum() (string, error) {
 		return "", err
 	}
 
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if err := ioutil.WriteFile(a.checksumPath(), []byte(checksum), 0600); err != nil {
+		a.Server.Log().WithField("error", err).Warn("failed to cache checksum of server archive")
+	}
+
+	return checksum, nil
+}
+
+// Returns the path to the snapshot of the files that were sent to another node during the
+// pre-sync phase of a transfer.
+func (a *Archiver) snapshotPath() string {
+	return filepath.Join(config.Get().System.ArchiveDirectory, a.Server.Id()+".snapshot.json")
+}
+
+// Saves a snapshot of the files that were sent to another node while the server was still
+// running. Once the server has been stopped only the files that have changed since this
+// snapshot need to be sent.
+func (a *Archiver) SaveSnapshot(files []backup.ManifestFile) error {
+	b, err := json.Marshal(files)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := ioutil.WriteFile(a.snapshotPath(), b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Removes the snapshot saved during the pre-sync, if there is one.
+func (a *Archiver) RemoveSnapshot() error {
+	if err := os.Remove(a.snapshotPath()); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Compares the files for the server against the snapshot saved during the pre-sync, returning
+// the files that are new or have a different size or modification time, along with the names
+// of any files in the snapshot that no longer exist.
+func (a *Archiver) Delta() (*backup.IncludedFiles, []string, error) {
+	b, err := ioutil.ReadFile(a.snapshotPath())
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var files []backup.ManifestFile
+	if err := json.Unmarshal(b, &files); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	snapshot := make(map[string]backup.ManifestFile, len(files))
+	for _, f := range files {
+		snapshot[f.Name] = f
+	}
+
+	root := a.Server.Filesystem().Path()
+	included, err := a.Server.Filesystem().GetIncludedFiles(root, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := new(backup.IncludedFiles)
+	seen := make(map[string]bool)
+	for _, p := range included.All() {
+		name := strings.TrimPrefix(p, root)
+		seen[name] = true
+
+		st, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, nil, errors.WithStack(err)
+		}
+
+		if f, ok := snapshot[name]; !ok || f.Size != st.Size() || !f.ModTime.Equal(st.ModTime()) {
+			changed.Push(p)
+		}
+	}
+
+	var deleted []string
+	for name := range snapshot {
+		if !seen[name] {
+			deleted = append(deleted, name)
+		}
+	}
+
+	return changed, deleted, nil
 }
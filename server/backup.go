@@ -1,13 +1,23 @@
 package server
 
 import (
+	"archive/tar"
 	"bufio"
+	"context"
+	"fmt"
 	"github.com/apex/log"
 	"github.com/pkg/errors"
 	"github.com/pterodactyl/wings/api"
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/environment"
+	"github.com/pterodactyl/wings/events"
 	"github.com/pterodactyl/wings/server/backup"
+	"github.com/pterodactyl/wings/server/filesystem"
+	"io"
 	"os"
 	"path"
+	"strings"
+	"time"
 )
 
 // Notifies the panel of a backup's state and returns an error if one is encountered
@@ -77,13 +87,14 @@ func (s *Server) GetIncludedBackupFiles(ignored []string) (*backup.IncludedFiles
 // let the actual backup system handle notifying the panel of the status, but that
 // won't emit a websocket event.
 func (s *Server) Backup(b backup.BackupInterface) error {
-	// Get the included files based on the root path and the ignored files provided.
-	inc, err := s.GetIncludedBackupFiles(b.Ignored())
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	ad, err := b.Generate(inc, s.Filesystem().Path())
+	// Track the backup so that it can be cancelled while it is queued or running.
+	s.trackBackupJob(b.Identifier(), cancel)
+	defer s.untrackBackupJob(b.Identifier())
+
+	ad, err := s.generateBackup(ctx, b)
 	if err != nil {
 		if notifyError := s.notifyPanelOfBackup(b.Identifier(), &backup.ArchiveDetails{}, false); notifyError != nil {
 			s.Log().WithFields(log.Fields{
@@ -96,7 +107,7 @@ func (s *Server) Backup(b backup.BackupInterface) error {
 			"uuid":          b.Identifier(),
 			"is_successful": false,
 			"checksum":      "",
-			"checksum_type": "sha1",
+			"checksum_type": "",
 			"file_size":     0,
 		})
 
@@ -117,9 +128,310 @@ func (s *Server) Backup(b backup.BackupInterface) error {
 		"uuid":          b.Identifier(),
 		"is_successful": true,
 		"checksum":      ad.Checksum,
-		"checksum_type": "sha1",
+		"checksum_type": ad.ChecksumType,
 		"file_size":     ad.Size,
 	})
 
+	s.pruneBackups()
+
 	return nil
 }
+
+// Removes any backups stored on the node for this server that are no longer kept by the
+// retention policy, and notifies the panel of each backup that was removed.
+func (s *Server) pruneBackups() {
+	pruned, err := backup.Prune(s.Id(), config.Get().System.Backups.Retention)
+	if err != nil {
+		s.Log().WithField("error", err).Warn("failed to apply backup retention policy")
+	}
+
+	for _, uuid := range pruned {
+		s.Log().WithField("backup", uuid).Info("removed backup not kept by retention policy")
+
+		if err := api.New().SendBackupPruned(uuid); err != nil {
+			s.Log().WithFields(log.Fields{
+				"backup": uuid,
+				"error":  err,
+			}).Warn("failed to notify panel of pruned backup")
+		}
+	}
+}
+
+// Restores a backup to the server. The server process is stopped before any files are written
+// and cannot be started again until the restoration has finished. If truncate is true all of
+// the existing server files are removed before the contents of the backup are written.
+//
+// The server must already be marked as restoring using StartRestoring, the mark is cleared
+// once the restoration has finished. Once complete the panel is notified of the restoration
+// status and an event is emitted over the server websocket, regardless of whether or not the
+// process was successful.
+func (s *Server) RestoreBackup(b backup.BackupInterface, truncate bool) (err error) {
+	defer s.SetRestoring(false)
+
+	defer func() {
+		if notifyError := api.New().SendRestorationStatus(b.Identifier(), err == nil); notifyError != nil {
+			s.Log().WithFields(log.Fields{
+				"backup": b.Identifier(),
+				"error":  notifyError,
+			}).Warn("failed to notify panel of backup restoration state")
+		}
+
+		s.Events().PublishJson(BackupRestoreCompletedEvent+":"+b.Identifier(), map[string]interface{}{
+			"uuid":          b.Identifier(),
+			"is_successful": err == nil,
+		})
+	}()
+
+	if s.GetState() != environment.ProcessOfflineState {
+		s.Log().WithField("backup", b.Identifier()).Info("stopping server instance before restoring backup")
+		if err := s.HandlePowerAction(PowerActionStop, 30); err != nil {
+			return errors.Wrap(err, "failed to stop server before restoring backup")
+		}
+	}
+
+	if truncate {
+		s.Log().WithField("backup", b.Identifier()).Info("removing existing server files before restoring backup")
+		if err := s.Filesystem().TruncateRootDirectory(); err != nil {
+			return errors.Wrap(err, "failed to truncate server directory before restoring backup")
+		}
+	}
+
+	s.Events().Publish(DaemonMessageEvent, "Restoring server files from backup...")
+
+	var skipped []string
+	err = b.Restore(func(header *tar.Header, r io.Reader) error {
+		s.Events().Publish(DaemonMessageEvent, "(restoring): "+header.Name)
+
+		return s.extractBackupEntry(header, r, &skipped)
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "error while restoring server backup")
+	}
+
+	if len(skipped) > 0 {
+		return skippedEntriesError(skipped)
+	}
+
+	s.Events().Publish(DaemonMessageEvent, "Completed server restoration from backup.")
+
+	return nil
+}
+
+// Restores only the files in the backup that match the given paths. Unlike a full restoration
+// the server is not stopped and the existing files are not removed, making this suitable for
+// recovering a single configuration file. An event is emitted over the server websocket once
+// complete, but the panel is not notified since the backup was not fully restored. The server
+// must already be marked as restoring using StartRestoring, it is unmarked once complete.
+func (s *Server) RestoreBackupFiles(b backup.BackupInterface, paths []string) (err error) {
+	defer s.SetRestoring(false)
+	defer func() {
+		s.Events().PublishJson(BackupRestoreCompletedEvent+":"+b.Identifier(), map[string]interface{}{
+			"uuid":          b.Identifier(),
+			"is_successful": err == nil,
+			"files":         paths,
+		})
+	}()
+
+	s.Events().Publish(DaemonMessageEvent, "Restoring selected files from backup...")
+
+	match := backup.MatchPaths(paths)
+	var skipped []string
+	err = b.Restore(func(header *tar.Header, r io.Reader) error {
+		if !match(header.Name) {
+			return nil
+		}
+
+		s.Events().Publish(DaemonMessageEvent, "(restoring): "+header.Name)
+
+		return s.extractBackupEntry(header, r, &skipped)
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "error while restoring files from server backup")
+	}
+
+	if len(skipped) > 0 {
+		return skippedEntriesError(skipped)
+	}
+
+	s.Events().Publish(DaemonMessageEvent, "Completed restoring selected files from backup.")
+
+	return nil
+}
+
+// Extracts a single entry from a backup to the server's filesystem. Entries that cannot be
+// restored, such as device files or symlinks pointing outside of the server's data directory,
+// are added to skipped rather than stopping the restoration so that everything else is still
+// restored.
+func (s *Server) extractBackupEntry(header *tar.Header, r io.Reader, skipped *[]string) error {
+	err := s.Filesystem().ExtractEntry(header, r)
+	if errors.Is(err, filesystem.ErrUnsupportedArchiveEntry) {
+		s.Log().WithFields(log.Fields{
+			"file":  header.Name,
+			"error": err,
+		}).Warn("skipping backup entry that cannot be restored")
+
+		*skipped = append(*skipped, header.Name)
+
+		return nil
+	}
+
+	return err
+}
+
+// Returns the error reported once a restoration has finished when some of the entries in the
+// backup could not be restored.
+func skippedEntriesError(skipped []string) error {
+	return errors.Errorf("backup restored, but the following entries could not be restored: %s", strings.Join(skipped, ", "))
+}
+
+// Generates the backup, executing any hooks that were provided against the server console
+// before and after the archive is created. Hooks are only executed if the server is running,
+// otherwise there is nothing listening on the console to receive the commands. Once the pre
+// hooks have started the post hooks are always executed, even if the backup fails, so that
+// the server is never left in a quiesced state.
+func (s *Server) generateBackup(ctx context.Context, b backup.BackupInterface) (*backup.ArchiveDetails, error) {
+	// Wait for a slot in the node-wide backup queue before doing anything, this prevents a
+	// large number of backups from saturating the disks on the node all at once.
+	release, err := backupQueue.Acquire(ctx, s, b.Identifier())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer release()
+
+	if h := b.Hooks(); h != nil && s.GetState() == environment.ProcessRunningState {
+		defer func() {
+			if err := s.runBackupHooks(h.Post, h.WaitTimeout()); err != nil {
+				s.Log().WithFields(log.Fields{
+					"backup": b.Identifier(),
+					"error":  err,
+				}).Warn("failed to execute post-backup hooks for server")
+			}
+		}()
+
+		if err := s.runBackupHooks(h.Pre, h.WaitTimeout()); err != nil {
+			return nil, errors.Wrap(err, "failed to execute pre-backup hooks")
+		}
+	}
+
+	// Get the included files based on the root path and the ignored files provided.
+	inc, err := s.GetIncludedBackupFiles(b.Ignored())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	b.Progress().Track(inc)
+
+	done := make(chan bool)
+	defer close(done)
+	go s.publishBackupProgress(b, done)
+
+	return b.Generate(ctx, inc, s.Filesystem().Path())
+}
+
+// Periodically emits the progress of a backup over the server websocket until the done
+// channel is closed.
+func (s *Server) publishBackupProgress(b backup.BackupInterface, done chan bool) {
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			files, totalFiles := b.Progress().Files()
+			bytes, totalBytes := b.Progress().Bytes()
+
+			s.Events().PublishJson(BackupProgressEvent+":"+b.Identifier(), map[string]interface{}{
+				"uuid":        b.Identifier(),
+				"files":       files,
+				"total_files": totalFiles,
+				"bytes":       bytes,
+				"total_bytes": totalBytes,
+			})
+		}
+	}
+}
+
+// Tracks a backup that is being generated for the server so that it can be cancelled.
+func (s *Server) trackBackupJob(uuid string, cancel context.CancelFunc) {
+	s.backupJobsMu.Lock()
+	defer s.backupJobsMu.Unlock()
+
+	if s.backupJobs == nil {
+		s.backupJobs = make(map[string]context.CancelFunc)
+	}
+
+	s.backupJobs[uuid] = cancel
+}
+
+func (s *Server) untrackBackupJob(uuid string) {
+	s.backupJobsMu.Lock()
+	defer s.backupJobsMu.Unlock()
+
+	delete(s.backupJobs, uuid)
+}
+
+// Cancels a backup that is currently queued or being generated for the server. Returns false
+// if there is no running backup with the given UUID. The backup is reported to the panel as
+// having failed once it has stopped.
+func (s *Server) CancelBackup(uuid string) bool {
+	s.backupJobsMu.Lock()
+	defer s.backupJobsMu.Unlock()
+
+	cancel, ok := s.backupJobs[uuid]
+	if ok {
+		cancel()
+	}
+
+	return ok
+}
+
+// Executes a series of backup hooks against the server console. Each command is sent to the
+// server in order, and if the hook defines a line of output to wait for the next hook is not
+// executed until that line is output by the server, or the timeout is reached.
+func (s *Server) runBackupHooks(hooks []backup.Hook, timeout time.Duration) error {
+	for _, h := range hooks {
+		if err := s.runBackupHook(h, timeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) runBackupHook(h backup.Hook, timeout time.Duration) error {
+	s.Log().WithField("command", h.Command).Debug("executing backup hook for server")
+
+	if h.WaitFor == nil {
+		return errors.WithStack(s.Environment.SendCommand(h.Command))
+	}
+
+	// Register the listener before sending the command so that output produced immediately
+	// after the command is received is not missed.
+	matched := make(chan bool, 1)
+	listener := func(e events.Event) {
+		if h.WaitFor.Matches(stripAnsiRegex.ReplaceAllString(e.Data, "")) {
+			select {
+			case matched <- true:
+			default:
+			}
+		}
+	}
+
+	s.Environment.Events().On(environment.ConsoleOutputEvent, &listener)
+	defer s.Environment.Events().Off(environment.ConsoleOutputEvent, &listener)
+
+	if err := s.Environment.SendCommand(h.Command); err != nil {
+		return errors.WithStack(err)
+	}
+
+	select {
+	case <-matched:
+		return nil
+	case <-time.After(timeout):
+		return errors.New(fmt.Sprintf("timed out waiting for output matching \"%s\" after running backup hook", h.WaitFor.String()))
+	}
+}
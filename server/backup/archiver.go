@@ -3,23 +3,76 @@ package backup
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/apex/log"
-	gzip "github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/system"
 	"github.com/remeh/sizedwaitgroup"
 	"golang.org/x/sync/errgroup"
 	"io"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 )
 
+// The rate limiter shared by every backup being generated on the node, this caps the total
+// rate at which files are read from the disk while backups are being created.
+var readLimiter = system.NewRateLimiter(0)
+
+// Returns the rate limiter used when reading files for a backup, making sure that it is using
+// the latest limit from the configuration.
+func backupReadLimiter() *system.RateLimiter {
+	if l := config.Get().System.Backups.ReadLimit; readLimiter.Limit() != l {
+		readLimiter.SetLimit(l)
+	}
+
+	return readLimiter
+}
+
 type Archive struct {
 	sync.Mutex
 
 	TrimPrefix string
 	Files      *IncludedFiles
+
+	// The key used to encrypt the archive, if no key is provided the archive is written
+	// without any encryption.
+	EncryptionKey []byte
+
+	// Tracks the progress of the archive as files are added to it, this is optional.
+	Progress *Progress
+
+	// The compression format and level to use for the archive. If not set the archive is
+	// compressed using gzip at the fastest compression level.
+	Format           ArchiveFormat
+	CompressionLevel int
+
+	// The rate limiter applied when reading files for the archive. If not set the limiter
+	// shared by every backup on the node is used.
+	Limiter *system.RateLimiter
+
+	// Every file that has been written to the archive, used to generate a manifest once
+	// the archive has been created.
+	contents []ManifestFile
+}
+
+// Returns the details of every file that was written to the archive.
+func (a *Archive) Contents() []ManifestFile {
+	a.Lock()
+	defer a.Unlock()
+
+	return append([]ManifestFile{}, a.contents...)
+}
+
+// Returns the rate limiter to use when reading files for the archive.
+func (a *Archive) readLimiter() *system.RateLimiter {
+	if a.Limiter != nil {
+		return a.Limiter
+	}
+
+	return backupReadLimiter()
 }
 
 // Creates an archive at dst with all of the files defined in the included files struct.
@@ -28,23 +81,71 @@ func (a *Archive) Create(dst string, ctx context.Context) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	defer f.Close()
 
-	maxCpu := runtime.NumCPU() / 2
-	if maxCpu > 4 {
-		maxCpu = 4
+	err = a.Stream(ctx, f)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = errors.WithStack(cerr)
+	}
+
+	if err != nil {
+		// Attempt to remove the archive if there is an error, report that error to
+		// the logger if it fails.
+		if rerr := os.Remove(dst); rerr != nil && !os.IsNotExist(rerr) {
+			log.WithField("location", dst).Warn("failed to delete corrupted backup archive")
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Writes a compressed tar archive containing all of the files defined in the included
+// files struct to the given writer. The archive is fully flushed to the writer by the time
+// this function returns.
+func (a *Archive) Stream(ctx context.Context, w io.Writer) error {
+	var ew io.WriteCloser
+	if len(a.EncryptionKey) > 0 {
+		e, err := newEncryptedWriter(w, a.EncryptionKey)
+		if err != nil {
+			return err
+		}
+
+		ew, w = e, e
 	}
 
-	gzw, _ := gzip.NewWriterLevel(f, gzip.BestSpeed)
-	_ = gzw.SetConcurrency(1<<20, maxCpu)
+	cw, err := newCompressedWriter(w, a.Format, a.CompressionLevel)
+	if err != nil {
+		if ew != nil {
+			ew.Close()
+		}
 
-	defer gzw.Flush()
-	defer gzw.Close()
+		return err
+	}
 
-	tw := tar.NewWriter(gzw)
-	defer tw.Flush()
-	defer tw.Close()
+	tw := tar.NewWriter(cw)
 
+	err = a.writeFiles(ctx, tw)
+
+	// Closing each writer flushes anything it has buffered and writes its footer to the next
+	// writer, so they must be closed in order from the tar writer outwards. If any of them
+	// fails the archive is incomplete, even if every file was written successfully.
+	closers := []io.Closer{tw, cw}
+	if ew != nil {
+		closers = append(closers, ew)
+	}
+
+	for _, c := range closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}
+
+	return err
+}
+
+// Writes every included file to the tar writer.
+func (a *Archive) writeFiles(ctx context.Context, tw *tar.Writer) error {
 	wg := sizedwaitgroup.New(10)
 	g, ctx := errgroup.WithContext(ctx)
 	// Iterate over all of the files to be included and put them into the archive. This is
@@ -60,21 +161,13 @@ func (a *Archive) Create(dst string, ctx context.Context) error {
 			case <-ctx.Done():
 				return errors.WithStack(ctx.Err())
 			default:
-				return a.addToArchive(p, tw)
+				return a.addToArchive(ctx, p, tw)
 			}
 		})
 	}
 
 	// Block until the entire routine is completed.
 	if err := g.Wait(); err != nil {
-		f.Close()
-
-		// Attempt to remove the archive if there is an error, report that error to
-		// the logger if it fails.
-		if rerr := os.Remove(dst); rerr != nil && !os.IsNotExist(rerr) {
-			log.WithField("location", dst).Warn("failed to delete corrupted backup archive")
-		}
-
 		return errors.WithStack(err)
 	}
 
@@ -82,7 +175,7 @@ func (a *Archive) Create(dst string, ctx context.Context) error {
 }
 
 // Adds a single file to the existing tar archive writer.
-func (a *Archive) addToArchive(p string, w *tar.Writer) error {
+func (a *Archive) addToArchive(ctx context.Context, p string, w *tar.Writer) error {
 	f, err := os.Open(p)
 	if err != nil {
 		// If you try to backup something that no longer exists (got deleted somewhere during the process
@@ -123,10 +216,47 @@ func (a *Archive) addToArchive(p string, w *tar.Writer) error {
 		return errors.WithStack(err)
 	}
 
+	h := sha256.New()
+	r := &progressReader{ctx: ctx, r: a.readLimiter().Reader(io.TeeReader(f, h)), progress: a.Progress}
+
+	// The file could be written to while it is being read, since the server may still be running.
+	// Exactly the number of bytes in the header must be written to the archive, so anything added
+	// to the file after it was checked is ignored, and if the file got shorter the remainder is
+	// filled with zeros. The modification time will have changed as well, so the file is sent
+	// again during the final phase of a transfer.
 	buf := make([]byte, 4*1024)
-	if _, err := io.CopyBuffer(w, f, buf); err != nil {
+	n, err := io.CopyBuffer(w, io.LimitReader(r, header.Size), buf)
+	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	if n < header.Size {
+		log.WithField("path", p).Debug("file was truncated while being archived, padding the remainder with zeros")
+
+		if _, err := io.CopyBuffer(io.MultiWriter(w, h), io.LimitReader(zeroReader{}, header.Size-n), buf); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	a.Progress.addFile()
+	a.contents = append(a.contents, ManifestFile{
+		Name:    header.Name,
+		Size:    s.Size(),
+		Mode:    s.Mode(),
+		ModTime: s.ModTime(),
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+	})
+
 	return nil
 }
+
+// A reader that returns an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
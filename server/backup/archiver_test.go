@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	. "github.com/franela/goblin"
+	"github.com/pterodactyl/wings/system"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A writer that calls a function the first time anything is written to it. The archive is
+// compressed, so the first write only happens once the archiver is part way through reading
+// the file.
+type onWrite struct {
+	bytes.Buffer
+	once sync.Once
+	fn   func()
+}
+
+func (w *onWrite) Write(p []byte) (int, error) {
+	w.once.Do(w.fn)
+
+	return w.Buffer.Write(p)
+}
+
+func TestArchiveStream(t *testing.T) {
+	g := Goblin(t)
+
+	var dir string
+	var data []byte
+
+	stream := func(fn func(p string)) (*Archive, map[string][]byte, error) {
+		p := filepath.Join(dir, "latest.log")
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			panic(err)
+		}
+
+		files := new(IncludedFiles)
+		files.Push(p)
+
+		a := &Archive{TrimPrefix: dir, Files: files, Limiter: system.NewRateLimiter(0)}
+		w := &onWrite{fn: func() { fn(p) }}
+		if err := a.Stream(context.Background(), w); err != nil {
+			return nil, nil, err
+		}
+
+		out := make(map[string][]byte)
+		err := walkTarArchive(&w.Buffer, func(header *tar.Header, r io.Reader) error {
+			b, err := ioutil.ReadAll(r)
+			out[header.Name] = b
+
+			return err
+		})
+
+		return a, out, err
+	}
+
+	g.Describe("Stream", func() {
+		g.BeforeEach(func() {
+			var err error
+			if dir, err = ioutil.TempDir(os.TempDir(), "pterodactyl"); err != nil {
+				panic(err)
+			}
+
+			// Random data does not compress, so the archive is written out while the file is
+			// still being read.
+			data = make([]byte, 1024*1024)
+			if _, err := rand.Read(data); err != nil {
+				panic(err)
+			}
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("only archives the original contents of a file that grows", func() {
+			a, out, err := stream(func(p string) {
+				f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					panic(err)
+				}
+				defer f.Close()
+
+				if _, err := f.Write([]byte(strings.Repeat("a", 64*1024))); err != nil {
+					panic(err)
+				}
+			})
+
+			g.Assert(err).IsNil()
+			g.Assert(bytes.Equal(out["/latest.log"], data)).IsTrue()
+			g.Assert(a.Contents()[0].Size).Equal(int64(len(data)))
+		})
+
+		g.It("pads a file that is truncated with zeros", func() {
+			a, out, err := stream(func(p string) {
+				if err := os.Truncate(p, 512*1024+1); err != nil {
+					panic(err)
+				}
+			})
+
+			g.Assert(err).IsNil()
+			g.Assert(len(out["/latest.log"])).Equal(len(data))
+			g.Assert(a.Contents()[0].Size).Equal(int64(len(data)))
+		})
+	})
+}
@@ -1,7 +1,9 @@
 package backup
 
 import (
-	"crypto/sha1"
+	"archive/tar"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"github.com/apex/log"
 	"github.com/pkg/errors"
@@ -14,14 +16,22 @@ import (
 )
 
 const (
-	LocalBackupAdapter = "wings"
-	S3BackupAdapter    = "s3"
+	LocalBackupAdapter       = "wings"
+	S3BackupAdapter          = "s3"
+	IncrementalBackupAdapter = "wings_incremental"
 )
 
+// A callback function that is executed for every entry contained within a backup archive
+// when it is being restored. This includes directories and symlinks as well as regular files.
+// The name of the entry is relative to the root of the server data directory, and the reader
+// will only return the contents of that single entry.
+type RestoreCallback func(header *tar.Header, r io.Reader) error
+
 type ArchiveDetails struct {
 	Checksum     string `json:"checksum"`
 	ChecksumType string `json:"checksum_type"`
 	Size         int64  `json:"size"`
+	Encryption   string `json:"encryption"`
 }
 
 // Returns a request object.
@@ -31,6 +41,7 @@ func (ad *ArchiveDetails) ToRequest(successful bool) api.BackupRequest {
 		ChecksumType: ad.ChecksumType,
 		Size:         ad.Size,
 		Successful:   successful,
+		Encryption:   ad.Encryption,
 	}
 }
 
@@ -42,6 +53,25 @@ type Backup struct {
 	// An array of files to ignore when generating this backup. This should be
 	// compatible with a standard .gitignore structure.
 	IgnoredFiles []string `json:"ignored_files"`
+
+	// The base64 encoded key used to encrypt this backup. If empty the key configured for
+	// the node is used instead, and if that is also empty the backup is not encrypted.
+	EncryptionKey string `json:"-"`
+
+	// The UUID of the server that this backup is being generated for.
+	Server string `json:"-"`
+
+	// The hooks to execute against the server console around the generation of this
+	// backup, if any.
+	hooks *Hooks
+
+	// The archive format, compression level and checksum type to use for this backup. These
+	// fall back to a gzip compressed archive with a sha1 checksum if not set.
+	Format           ArchiveFormat `json:"-"`
+	CompressionLevel int           `json:"-"`
+	ChecksumType     string        `json:"-"`
+
+	progress Progress
 }
 
 // noinspection GoNameStartsWithPackageName
@@ -50,12 +80,19 @@ type BackupInterface interface {
 	Identifier() string
 
 	// Generates a backup in whatever the configured source for the specific
-	// implementation is.
-	Generate(*IncludedFiles, string) (*ArchiveDetails, error)
+	// implementation is. Cancelling the context aborts the backup.
+	Generate(context.Context, *IncludedFiles, string) (*ArchiveDetails, error)
+
+	// Returns the progress tracker for the backup while it is being generated.
+	Progress() *Progress
 
 	// Returns the ignored files for this backup instance.
 	Ignored() []string
 
+	// Returns the console hooks to execute when generating this backup, this will
+	// be nil if no hooks were provided.
+	Hooks() *Hooks
+
 	// Returns a SHA256 checksum for the generated backup.
 	Checksum() ([]byte, error)
 
@@ -72,6 +109,17 @@ type BackupInterface interface {
 
 	// Removes a backup file.
 	Remove() error
+
+	// Restores the contents of the backup by reading the archive from wherever it is
+	// stored and passing each file contained within it to the callback.
+	Restore(RestoreCallback) error
+
+	// Returns a manifest listing every file contained within the backup.
+	Contents() (*Manifest, error)
+
+	// Reads the entire backup to confirm that it is intact, returning the checksum that
+	// was calculated for it. An error is returned if the backup is corrupted.
+	Verify() (*ArchiveDetails, error)
 }
 
 func (b *Backup) Identifier() string {
@@ -80,7 +128,7 @@ func (b *Backup) Identifier() string {
 
 // Returns the path for this specific backup.
 func (b *Backup) Path() string {
-	return path.Join(config.Get().System.BackupDirectory, b.Identifier()+".tar.gz")
+	return path.Join(config.Get().System.BackupDirectory, b.Identifier()+b.Format.Extension())
 }
 
 // Return the size of the generated backup.
@@ -93,11 +141,19 @@ func (b *Backup) Size() (int64, error) {
 	return st.Size(), nil
 }
 
-// Returns the SHA256 checksum of a backup.
+// Returns the checksum of a backup using the checksum type for the backup.
 func (b *Backup) Checksum() ([]byte, error) {
-	h := sha1.New()
+	return checksumFile(b.Path(), b.ChecksumType)
+}
+
+// Returns the checksum of the file at the given path using the given checksum type.
+func checksumFile(p string, t string) ([]byte, error) {
+	h, err := newChecksumHash(t)
+	if err != nil {
+		return nil, err
+	}
 
-	f, err := os.Open(b.Path())
+	f, err := os.Open(p)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -148,7 +204,7 @@ func (b *Backup) Details() *ArchiveDetails {
 
 	return &ArchiveDetails{
 		Checksum:     checksum,
-		ChecksumType: "sha1",
+		ChecksumType: checksumTypeOrDefault(b.ChecksumType),
 		Size:         sz,
 	}
 }
@@ -156,3 +212,102 @@ func (b *Backup) Details() *ArchiveDetails {
 func (b *Backup) Ignored() []string {
 	return b.IgnoredFiles
 }
+
+func (b *Backup) Hooks() *Hooks {
+	return b.hooks
+}
+
+func (b *Backup) Progress() *Progress {
+	return &b.progress
+}
+
+// Returns the decoded key that should be used to encrypt or decrypt this backup.
+func (b *Backup) encryptionKey() ([]byte, error) {
+	return resolveEncryptionKey(b.EncryptionKey)
+}
+
+// Reads a compressed tar archive from the given reader and passes each entry contained within
+// it along to the callback function. Encrypted archives are decrypted using the provided key,
+// and the compression format is detected automatically.
+func restoreFromReader(r io.Reader, key string, callback RestoreCallback) error {
+	return walkArchive(r, key, callback)
+}
+
+// Reads a compressed tar archive and passes each entry contained within it to the callback. This
+// is used to extract archives that are streamed from another node rather than read from a backup.
+// These archives are never encrypted, so no attempt is made to decrypt them.
+func ExtractArchive(r io.Reader, callback RestoreCallback) error {
+	return walkTarArchive(r, callback)
+}
+
+// Builds a manifest for a backup by reading through the entire archive. This is used for
+// backups that do not have a manifest stored alongside them.
+func manifestFromReader(uuid string, r io.Reader, key string) (*Manifest, error) {
+	m := &Manifest{Uuid: uuid}
+
+	err := walkArchive(r, key, func(header *tar.Header, r io.Reader) error {
+		if !header.FileInfo().Mode().IsRegular() {
+			return nil
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return errors.WithStack(err)
+		}
+
+		m.Files = append(m.Files, ManifestFile{
+			Name:    header.Name,
+			Size:    header.Size,
+			Mode:    header.FileInfo().Mode(),
+			ModTime: header.ModTime,
+			Hash:    hex.EncodeToString(h.Sum(nil)),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Reads a compressed, and optionally encrypted, tar archive and calls the callback for every
+// entry contained within it.
+func walkArchive(r io.Reader, key string, callback func(header *tar.Header, r io.Reader) error) error {
+	r, _, err := DecryptReader(r, key)
+	if err != nil {
+		return err
+	}
+
+	return walkTarArchive(r, callback)
+}
+
+// Reads a compressed tar archive that is not encrypted, passing each entry contained within it
+// to the callback.
+func walkTarArchive(r io.Reader, callback func(header *tar.Header, r io.Reader) error) error {
+	dr, err := newDecompressedReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return errors.WithStack(err)
+		}
+
+		if err := callback(header, tr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
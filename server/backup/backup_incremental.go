@@ -0,0 +1,357 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/apex/log"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"github.com/remeh/sizedwaitgroup"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type IncrementalBackup struct {
+	Backup
+}
+
+var _ BackupInterface = (*IncrementalBackup)(nil)
+
+// Locates an incremental backup on the system by checking for the existence of its manifest.
+func LocateIncremental(uuid string) (*IncrementalBackup, os.FileInfo, error) {
+	b := &IncrementalBackup{
+		Backup{
+			Uuid:         uuid,
+			IgnoredFiles: nil,
+		},
+	}
+
+	st, err := os.Stat(b.Path())
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if st.IsDir() {
+		return nil, nil, errors.New("invalid manifest, is directory")
+	}
+
+	return b, st, nil
+}
+
+// Returns the path to the manifest for this backup. The chunks themselves are stored in a
+// shared directory so that they can be re-used between backups.
+func (b *IncrementalBackup) Path() string {
+	return path.Join(config.Get().System.BackupDirectory, b.Identifier()+".manifest.json")
+}
+
+// Reads the manifest for this backup from the disk.
+func (b *IncrementalBackup) Manifest() (*Manifest, error) {
+	return readManifest(b.Path())
+}
+
+// Returns the contents of the backup, which for an incremental backup is simply the manifest
+// that is used to store it.
+func (b *IncrementalBackup) Contents() (*Manifest, error) {
+	return b.Manifest()
+}
+
+// Generates a backup by splitting each of the included files into chunks and storing any
+// chunks that do not already exist in the chunk store. Once every file has been processed
+// a manifest is written that references all of the chunks used by this backup.
+func (b *IncrementalBackup) Generate(ctx context.Context, included *IncludedFiles, prefix string) (*ArchiveDetails, error) {
+	if err := os.MkdirAll(chunkDirectory(), 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	m := &Manifest{
+		Uuid:      b.Identifier(),
+		CreatedAt: time.Now(),
+		Server:    b.Server,
+		Adapter:   IncrementalBackupAdapter,
+	}
+
+	var mu sync.Mutex
+	wg := sizedwaitgroup.New(10)
+	g, ctx := errgroup.WithContext(ctx)
+	for _, p := range included.All() {
+		p := p
+		g.Go(func() error {
+			wg.Add()
+			defer wg.Done()
+
+			select {
+			case <-ctx.Done():
+				return errors.WithStack(ctx.Err())
+			default:
+			}
+
+			f, added, err := b.chunkFile(ctx, p, strings.TrimPrefix(p, prefix))
+			if f != nil {
+				mu.Lock()
+				m.Files = append(m.Files, *f)
+				m.AddedSize += added
+				mu.Unlock()
+			}
+
+			return err
+		})
+	}
+
+	err := g.Wait()
+	if err == nil {
+		err = chunks.Save()
+	}
+
+	if err == nil {
+		err = m.Write(b.Path())
+	}
+
+	// If anything went wrong while generating the backup release all of the chunks that were
+	// acquired so that they are not left sitting on the disk forever.
+	if err != nil {
+		if rerr := chunks.Release(m.Chunks()); rerr != nil {
+			log.WithField("backup", b.Identifier()).WithField("error", rerr).Warn("failed to release chunks for failed backup")
+		}
+
+		return nil, errors.WithStack(err)
+	}
+
+	return b.Details(), nil
+}
+
+// Splits a single file into chunks and stores them, returning the file entry and the number
+// of bytes that were written to the chunk store for it. If the file has been removed since the
+// backup started it is skipped. A partial file entry is returned alongside any error so that
+// the chunks acquired for it can be released.
+func (b *IncrementalBackup) chunkFile(ctx context.Context, p string, name string) (*ManifestFile, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+
+		return nil, 0, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	s, err := f.Stat()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+
+		return nil, 0, errors.WithStack(err)
+	}
+
+	mf := &ManifestFile{
+		Name:    name,
+		Mode:    s.Mode(),
+		ModTime: s.ModTime(),
+	}
+
+	h := sha256.New()
+	r := &progressReader{ctx: ctx, r: backupReadLimiter().Reader(io.TeeReader(f, h)), progress: b.Progress()}
+	buf := make([]byte, chunkSize)
+	var added int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hash, written, aerr := chunks.Acquire(buf[:n])
+			if aerr != nil {
+				return mf, added, aerr
+			}
+
+			added += written
+			mf.Size += int64(n)
+			mf.Chunks = append(mf.Chunks, hash)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return mf, added, errors.WithStack(err)
+		}
+	}
+
+	mf.Hash = hex.EncodeToString(h.Sum(nil))
+	b.Progress().addFile()
+
+	return mf, added, nil
+}
+
+// Removes the manifest for this backup and releases all of the chunks that it references.
+// Any chunks that are still referenced by other backups are left untouched.
+func (b *IncrementalBackup) Remove() error {
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+
+	// Remove the manifest before releasing the chunks. If the process dies between these two
+	// steps we only leak some disk space, rather than having a manifest that points to chunks
+	// which no longer exist.
+	if err := os.Remove(b.Path()); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return chunks.Release(m.Chunks())
+}
+
+// Returns the amount of disk space that was added to the node by this backup, which is the
+// manifest itself and any chunks that were not already stored by an earlier backup. Chunks
+// shared with earlier backups are not included, otherwise every incremental backup would be
+// reported as being nearly the full size of the server.
+func (b *IncrementalBackup) Size() (int64, error) {
+	m, err := b.Manifest()
+	if err != nil {
+		return 0, err
+	}
+
+	st, err := os.Stat(b.Path())
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return st.Size() + m.AddedSize, nil
+}
+
+// Returns the checksum of the manifest for this backup. Since every chunk is addressed by
+// the hash of its contents this covers the contents of the entire backup.
+func (b *IncrementalBackup) Checksum() ([]byte, error) {
+	return checksumFile(b.Path(), b.ChecksumType)
+}
+
+// Returns details about the backup.
+func (b *IncrementalBackup) Details() *ArchiveDetails {
+	var checksum string
+	if resp, err := b.Checksum(); err != nil {
+		log.WithFields(log.Fields{
+			"backup": b.Identifier(),
+			"error":  err,
+		}).Error("failed to calculate checksum for backup")
+	} else {
+		checksum = hex.EncodeToString(resp)
+	}
+
+	sz, err := b.Size()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"backup": b.Identifier(),
+			"error":  err,
+		}).Warn("failed to calculate size of backup")
+	}
+
+	return &ArchiveDetails{
+		Checksum:     checksum,
+		ChecksumType: checksumTypeOrDefault(b.ChecksumType),
+		Size:         sz,
+	}
+}
+
+// Restores the contents of an incremental backup by reassembling each file from its chunks
+// and passing it along to the callback, along with any directories in the manifest.
+func (b *IncrementalBackup) Restore(callback RestoreCallback) error {
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range m.Files {
+		header := &tar.Header{
+			Name:    f.Name,
+			Mode:    int64(f.Mode.Perm()),
+			ModTime: f.ModTime,
+		}
+
+		var r io.Reader
+		switch {
+		case f.Mode.IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = f.Size
+			r = &chunkReader{hashes: f.Chunks}
+		case f.Mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			r = bytes.NewReader(nil)
+		default:
+			continue
+		}
+
+		if err := callback(header, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Verifies the integrity of an incremental backup by reassembling every file from its chunks
+// and comparing the result against the hash stored in the manifest. Each chunk is checked
+// against its own hash as it is read.
+func (b *IncrementalBackup) Verify() (*ArchiveDetails, error) {
+	m, err := b.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range m.Files {
+		if !f.Mode.IsRegular() {
+			continue
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(h, &chunkReader{hashes: f.Chunks})
+		if err != nil {
+			return nil, err
+		}
+
+		if n != f.Size || (f.Hash != "" && hex.EncodeToString(h.Sum(nil)) != f.Hash) {
+			return nil, errors.New(fmt.Sprintf("backup: contents of file [%s] do not match the manifest", f.Name))
+		}
+	}
+
+	return b.Details(), nil
+}
+
+// Writes the contents of the backup to the given writer as a gzip compressed tar archive,
+// allowing an incremental backup to be downloaded in the same format as a local backup.
+func (b *IncrementalBackup) WriteArchive(w io.Writer) error {
+	m, err := b.Manifest()
+	if err != nil {
+		return err
+	}
+
+	gzw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	for _, f := range m.Files {
+		header := &tar.Header{
+			Name:    f.Name,
+			Size:    f.Size,
+			Mode:    int64(f.Mode),
+			ModTime: f.ModTime,
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if _, err := io.Copy(tw, &chunkReader{hashes: f.Chunks}); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
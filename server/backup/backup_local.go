@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/pkg/errors"
 	"os"
+	"time"
 )
 
 type LocalBackup struct {
@@ -22,7 +23,17 @@ func LocateLocal(uuid string) (*LocalBackup, os.FileInfo, error) {
 		},
 	}
 
-	st, err := os.Stat(b.Path())
+	// The format of the backup is not known ahead of time, so check for an archive in
+	// each of the supported formats.
+	var st os.FileInfo
+	var err error
+	for _, f := range archiveFormats {
+		b.Format = f
+		if st, err = os.Stat(b.Path()); err == nil || !os.IsNotExist(err) {
+			break
+		}
+	}
+
 	if err != nil {
 		return nil, nil, errors.WithStack(err)
 	}
@@ -34,22 +45,91 @@ func LocateLocal(uuid string) (*LocalBackup, os.FileInfo, error) {
 	return b, st, nil
 }
 
-// Removes a backup from the system.
+// Removes a backup from the system, along with the manifest for it.
 func (b *LocalBackup) Remove() error {
+	if err := os.Remove(b.manifestPath()); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
 	return os.Remove(b.Path())
 }
 
 // Generates a backup of the selected files and pushes it to the defined location
 // for this instance.
-func (b *LocalBackup) Generate(included *IncludedFiles, prefix string) (*ArchiveDetails, error) {
+func (b *LocalBackup) Generate(ctx context.Context, included *IncludedFiles, prefix string) (*ArchiveDetails, error) {
+	key, err := b.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
 	a := &Archive{
-		TrimPrefix: prefix,
-		Files:      included,
+		TrimPrefix:       prefix,
+		Files:            included,
+		EncryptionKey:    key,
+		Progress:         b.Progress(),
+		Format:           b.Format,
+		CompressionLevel: b.CompressionLevel,
+	}
+
+	if err := a.Create(b.Path(), ctx); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ad := b.Details()
+	ad.Encryption = encryptionScheme(key)
+
+	m := &Manifest{
+		Uuid:         b.Identifier(),
+		CreatedAt:    time.Now(),
+		Files:        a.Contents(),
+		Checksum:     ad.Checksum,
+		ChecksumType: ad.ChecksumType,
+		Server:       b.Server,
+		Adapter:      LocalBackupAdapter,
+	}
+	if err := m.Write(b.manifestPath()); err != nil {
+		return nil, err
+	}
+
+	return ad, nil
+}
+
+// Restores the contents of a local backup by opening the archive stored on the disk and
+// passing each file within it along to the callback.
+func (b *LocalBackup) Restore(callback RestoreCallback) error {
+	f, err := os.Open(b.Path())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return restoreFromReader(f, b.EncryptionKey, callback)
+}
+
+// Returns the contents of the backup. If no manifest was stored for the backup the archive
+// is read to generate one.
+func (b *LocalBackup) Contents() (*Manifest, error) {
+	m, err := readManifest(b.manifestPath())
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return m, err
 	}
 
-	if err := a.Create(b.Path(), context.Background()); err != nil {
+	f, err := os.Open(b.Path())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return manifestFromReader(b.Identifier(), f, b.EncryptionKey)
+}
+
+// Verifies the integrity of the archive stored on the disk.
+func (b *LocalBackup) Verify() (*ArchiveDetails, error) {
+	f, err := os.Open(b.Path())
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	defer f.Close()
 
-	return b.Details(), nil
+	return b.verify(backupReadLimiter().Reader(f))
 }
@@ -9,7 +9,44 @@ type Request struct {
 	Adapter      string   `json:"adapter"`
 	Uuid         string   `json:"uuid"`
 	IgnoredFiles []string `json:"ignored_files"`
-	PresignedUrl string   `json:"presigned_url"`
+
+	// The presigned URL to upload an S3 backup to in a single request. This is only used if
+	// the panel cannot provide the URLs for a multipart upload.
+	PresignedUrl string `json:"presigned_url"`
+
+	// An optional base64 encoded AES-256 key provided by the panel that is used to encrypt
+	// this specific backup, overriding any key configured for the node. This is not supported
+	// by incremental backups.
+	EncryptionKey string `json:"encryption_key"`
+
+	// Console commands to execute before and after the backup is generated.
+	Hooks *Hooks `json:"hooks"`
+
+	// The archive format and compression level to use when generating the backup, this is
+	// ignored for incremental backups since they are not stored as a single archive.
+	Format           ArchiveFormat `json:"format"`
+	CompressionLevel int           `json:"compression_level"`
+
+	// The type of checksum to generate for the backup, either sha1 or sha256. Defaults to sha1
+	// if not set.
+	ChecksumType string `json:"checksum_type"`
+
+	// The UUID of the server the backup is being generated for. This is not sent by the
+	// panel, it is set from the route that the request was received on.
+	Server string `json:"-"`
+}
+
+// Validates the archive format and checksum type provided in the request.
+func (r *Request) validate() error {
+	if err := r.Format.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := newChecksumHash(r.ChecksumType); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // Generates a new local backup struct.
@@ -18,10 +55,20 @@ func (r *Request) NewLocalBackup() (*LocalBackup, error) {
 		return nil, errors.New(fmt.Sprintf("cannot create local backup using [%s] adapter", r.Adapter))
 	}
 
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
 	return &LocalBackup{
 		Backup{
-			Uuid:         r.Uuid,
-			IgnoredFiles: r.IgnoredFiles,
+			Uuid:             r.Uuid,
+			IgnoredFiles:     r.IgnoredFiles,
+			EncryptionKey:    r.EncryptionKey,
+			Server:           r.Server,
+			hooks:            r.Hooks,
+			Format:           r.Format,
+			CompressionLevel: r.CompressionLevel,
+			ChecksumType:     r.ChecksumType,
 		},
 	}, nil
 }
@@ -32,15 +79,48 @@ func (r *Request) NewS3Backup() (*S3Backup, error) {
 		return nil, errors.New(fmt.Sprintf("cannot create s3 backup using [%s] adapter", r.Adapter))
 	}
 
-	if len(r.PresignedUrl) == 0 {
-		return nil, errors.New("a valid presigned S3 upload URL must be provided to use the [s3] adapter")
+	if err := r.validate(); err != nil {
+		return nil, err
 	}
 
 	return &S3Backup{
 		Backup: Backup{
+			Uuid:             r.Uuid,
+			IgnoredFiles:     r.IgnoredFiles,
+			EncryptionKey:    r.EncryptionKey,
+			Server:           r.Server,
+			hooks:            r.Hooks,
+			Format:           r.Format,
+			CompressionLevel: r.CompressionLevel,
+			ChecksumType:     r.ChecksumType,
+		},
+		PresignedUrl: r.PresignedUrl,
+	}, nil
+}
+
+// Generates a new incremental backup struct.
+func (r *Request) NewIncrementalBackup() (*IncrementalBackup, error) {
+	if r.Adapter != IncrementalBackupAdapter {
+		return nil, errors.New(fmt.Sprintf("cannot create incremental backup using [%s] adapter", r.Adapter))
+	}
+
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	// The chunks of an incremental backup are shared between every backup on the node, so
+	// they cannot be encrypted using a key that is specific to a single backup.
+	if r.EncryptionKey != "" {
+		return nil, errors.New("cannot encrypt backup using the [incremental] adapter")
+	}
+
+	return &IncrementalBackup{
+		Backup{
 			Uuid:         r.Uuid,
 			IgnoredFiles: r.IgnoredFiles,
+			Server:       r.Server,
+			hooks:        r.Hooks,
+			ChecksumType: r.ChecksumType,
 		},
-		PresignedUrl: r.PresignedUrl,
 	}, nil
 }
@@ -1,87 +1,493 @@
 package backup
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/api"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"strconv"
+	"time"
 )
 
 type S3Backup struct {
 	Backup
 
-	// The pre-signed upload endpoint for the generated backup. This must be
-	// provided otherwise this request will fail. This allows us to keep all
-	// of the keys off the daemon instances and the panel can handle generating
-	// the credentials for us.
+	// The pre-signed endpoint for the backup. When a backup is being restored this is the
+	// download endpoint for the backup object. When a backup is being generated this is only
+	// used by panels that do not support multipart uploads, in which case it is the upload
+	// endpoint for the entire archive. This allows us to keep all of the keys off the daemon
+	// instances and the panel can handle generating the credentials for us.
 	PresignedUrl string
 }
 
 var _ BackupInterface = (*S3Backup)(nil)
 
-// Generates a new backup on the disk, moves it into the S3 bucket via the provided
-// presigned URL, and then deletes the backup from the disk.
-func (s *S3Backup) Generate(included *IncludedFiles, prefix string) (*ArchiveDetails, error) {
-	defer s.Remove()
+var ErrMissingDownloadUrl = errors.New("backup: a presigned download URL is required to read an S3 backup")
+
+// Locates an S3 backup that was generated on this node by checking for the manifest that was
+// stored for it. The archive itself only exists in the bucket.
+func LocateS3(uuid string) (*S3Backup, error) {
+	b := &S3Backup{Backup: Backup{Uuid: uuid}}
+
+	m, err := readManifest(b.manifestPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Adapter != S3BackupAdapter {
+		return nil, errors.WithStack(os.ErrNotExist)
+	}
+
+	b.Server = m.Server
+
+	return b, nil
+}
+
+// The number of times that the upload of a single part will be attempted before the
+// entire backup is marked as failed.
+const s3PartUploadAttempts = 5
+
+// A completed part of a multipart upload, these are sent to S3 to complete the upload.
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Generates a new backup and streams it directly into the S3 bucket as a multipart upload
+// using the presigned part URLs provided by the panel. The archive is never written to the
+// disk, only the part currently being uploaded is kept in memory so that it can be retried if
+// the upload fails. If the panel cannot provide the part URLs but
+// did send a presigned URL for the entire archive the backup is uploaded in a single request.
+func (s *S3Backup) Generate(ctx context.Context, included *IncludedFiles, prefix string) (*ArchiveDetails, error) {
+	key, err := s.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
 
 	a := &Archive{
-		TrimPrefix: prefix,
-		Files:      included,
+		TrimPrefix:       prefix,
+		Files:            included,
+		EncryptionKey:    key,
+		Progress:         s.Progress(),
+		Format:           s.Format,
+		CompressionLevel: s.CompressionLevel,
+	}
+
+	var ad *ArchiveDetails
+	urls, err := api.New().GetBackupRemoteUploadURLs(s.Identifier(), estimateArchiveSize(included))
+	if err != nil {
+		if s.PresignedUrl == "" {
+			return nil, errors.WithStack(err)
+		}
+
+		log.WithField("backup", s.Identifier()).WithField("error", err).Debug("panel did not provide multipart upload URLs, uploading backup in a single request")
+
+		ad, err = s.generateSingle(ctx, a)
+	} else {
+		ad, err = s.generateMultipart(ctx, a, urls)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ad.Encryption = encryptionScheme(key)
+
+	// Keep a manifest of the backup on the node so that the contents of the backup can be
+	// listed without needing to download the entire archive from the bucket.
+	m := &Manifest{
+		Uuid:         s.Identifier(),
+		CreatedAt:    time.Now(),
+		Files:        a.Contents(),
+		Checksum:     ad.Checksum,
+		ChecksumType: ad.ChecksumType,
+		Server:       s.Server,
+		Adapter:      S3BackupAdapter,
+	}
+	if err := m.Write(s.manifestPath()); err != nil {
+		log.WithField("backup", s.Identifier()).WithField("error", err).Warn("failed to write manifest for S3 backup")
+	}
+
+	return ad, nil
+}
+
+// Streams the archive into a multipart upload. Once every part has been uploaded the upload is
+// completed, if anything goes wrong it is aborted so that the parts already uploaded are not
+// left in the bucket.
+func (s *S3Backup) generateMultipart(ctx context.Context, a *Archive, urls *api.BackupRemoteUploadResponse) (*ArchiveDetails, error) {
+	if len(urls.Parts) == 0 || urls.PartSize <= 0 || urls.CompleteUrl == "" || urls.AbortUrl == "" {
+		return nil, errors.New("backup: panel did not provide the presigned URLs required for the S3 upload")
+	}
+
+	ad, parts, err := s.uploadParts(ctx, a, urls, contentType(a))
+	if err == nil {
+		err = s.completeUpload(ctx, urls.CompleteUrl, parts)
+	}
+
+	if err != nil {
+		s.abortUpload(urls.AbortUrl)
+
+		return nil, err
+	}
+
+	return ad, nil
+}
+
+// Uploads each part of the archive to the presigned URLs provided by the panel, in order. Each
+// part is buffered in memory before it is uploaded, and the same buffer is reused for the next
+// part once it has been sent, so no more than a single part is ever held at once.
+func (s *S3Backup) uploadParts(ctx context.Context, a *Archive, urls *api.BackupRemoteUploadResponse, contentType string) (*ArchiveDetails, []s3Part, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(a.Stream(ctx, pw))
+	}()
+	// If the upload fails make sure that the archive stops being generated, otherwise it
+	// will block forever trying to write to the pipe.
+	defer pr.Close()
+
+	h, err := newChecksumHash(s.ChecksumType)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := io.TeeReader(pr, h)
+
+	var buf bytes.Buffer
+	var size int64
+	var parts []s3Part
+	for i := 0; ; i++ {
+		buf.Reset()
+
+		n, err := io.CopyN(&buf, r, urls.PartSize)
+		if err != nil && err != io.EOF {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		// Once the archive has been completely read there is nothing left to upload. This
+		// only occurs when the size of the archive is an exact multiple of the part size.
+		if n == 0 {
+			break
+		}
+
+		if i >= len(urls.Parts) {
+			return nil, nil, errors.New("backup: archive exceeded the number of presigned part URLs provided by the panel")
+		}
+
+		etag, uerr := s.uploadPart(ctx, urls.Parts[i], contentType, io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, n))
+		if uerr != nil {
+			return nil, nil, errors.WithStack(uerr)
+		}
+
+		size += n
+		parts = append(parts, s3Part{PartNumber: i + 1, ETag: etag})
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return &ArchiveDetails{
+		Checksum:     hex.EncodeToString(h.Sum(nil)),
+		ChecksumType: checksumTypeOrDefault(s.ChecksumType),
+		Size:         size,
+	}, parts, nil
+}
+
+// Completes the multipart upload once every part has been uploaded, which combines all of the
+// parts into the final backup object.
+func (s *S3Backup) completeUpload(ctx context.Context, url string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return s.retry(ctx, "failed to complete multipart upload to remote S3 endpoint", func() error {
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		r.ContentLength = int64(len(body))
+		r.Header.Add("Content-Type", "application/xml")
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to complete S3 multipart upload, %d:%s", resp.StatusCode, resp.Status)
+		}
+
+		// S3 can return a successful status code and still fail to complete the upload, in
+		// which case the error is only reported in the body of the response.
+		var res struct {
+			XMLName xml.Name
+			Code    string `xml:"Code"`
+		}
+		if xml.Unmarshal(b, &res) == nil && res.XMLName.Local == "Error" {
+			return fmt.Errorf("failed to complete S3 multipart upload, %s", res.Code)
+		}
+
+		return nil
+	})
+}
+
+// Aborts the multipart upload so that S3 removes any parts that have already been uploaded.
+// This is always attempted, even if the backup was cancelled.
+func (s *S3Backup) abortUpload(url string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := s.retry(ctx, "failed to abort multipart upload to remote S3 endpoint", func() error {
+		r, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to abort S3 multipart upload, %d:%s", resp.StatusCode, resp.Status)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.WithField("backup", s.Identifier()).WithField("error", err).Error("failed to abort multipart upload for failed S3 backup")
 	}
+}
 
-	if err := a.Create(s.Path(), context.Background()); err != nil {
+// Generates the archive on the disk and uploads it to the presigned URL in a single request,
+// removing the archive from the disk once it has been uploaded.
+func (s *S3Backup) generateSingle(ctx context.Context, a *Archive) (*ArchiveDetails, error) {
+	defer os.Remove(s.Path())
+
+	if err := a.Create(s.Path(), ctx); err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	rc, err := os.Open(s.Path())
+	f, err := os.Open(s.Path())
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	defer rc.Close()
+	defer f.Close()
 
-	if resp, err := s.generateRemoteRequest(rc); err != nil {
+	st, err := f.Stat()
+	if err != nil {
 		return nil, errors.WithStack(err)
-	} else {
-		resp.Body.Close()
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("failed to put S3 object, %d:%s", resp.StatusCode, resp.Status)
-		}
+	if _, err := s.uploadPart(ctx, s.PresignedUrl, contentType(a), io.NewSectionReader(f, 0, st.Size())); err != nil {
+		return nil, errors.WithStack(err)
 	}
 
-	return s.Details(), err
+	return s.Details(), nil
 }
 
-// Removes a backup from the system.
+// Only the manifest is stored on the disk for S3 backups. The object in the bucket is managed
+// by the panel, which removes it when the backup is deleted.
 func (s *S3Backup) Remove() error {
-	return os.Remove(s.Path())
+	if err := os.Remove(s.manifestPath()); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Calls fn until it succeeds, retrying failed attempts with an increasing delay between each
+// one. The last error is returned if every attempt fails.
+func (s *S3Backup) retry(ctx context.Context, msg string, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= s3PartUploadAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		// Don't bother retrying if the backup has been cancelled.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.WithFields(log.Fields{
+			"backup":  s.Identifier(),
+			"attempt": attempt,
+			"error":   err,
+		}).Warn(msg)
+
+		if attempt < s3PartUploadAttempts {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second * time.Duration(attempt*attempt)):
+			}
+		}
+	}
+
+	return err
+}
+
+// Uploads a single part of the backup to the given presigned URL and returns the ETag
+// from the response, which is required by S3 to complete the multipart upload. Failed
+// attempts are retried with an increasing delay between each one.
+func (s *S3Backup) uploadPart(ctx context.Context, url string, contentType string, data *io.SectionReader) (string, error) {
+	var etag string
+	err := s.retry(ctx, "failed to upload backup part to remote S3 endpoint", func() error {
+		var err error
+		etag, err = s.putPart(ctx, url, contentType, data)
+
+		return err
+	})
+
+	return etag, err
 }
 
-// Generates the remote S3 request and begins the upload.
-func (s *S3Backup) generateRemoteRequest(rc io.ReadCloser) (*http.Response, error) {
-	r, err := http.NewRequest(http.MethodPut, s.PresignedUrl, nil)
+// Performs the actual upload of a part to the remote S3 endpoint.
+func (s *S3Backup) putPart(ctx context.Context, url string, contentType string, data *io.SectionReader) (string, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPut, url, io.NewSectionReader(data, 0, data.Size()))
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	r.ContentLength = data.Size()
+	r.Header.Add("Content-Type", contentType)
+
+	log.WithFields(log.Fields{
+		"backup": s.Identifier(),
+		"size":   data.Size(),
+	}).Debug("uploading backup part to remote S3 endpoint")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to put S3 object part, %d:%s", resp.StatusCode, resp.Status)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("backup: S3 part upload response did not include an ETag")
 	}
 
-	if sz, err := s.Size(); err != nil {
+	return etag, nil
+}
+
+// Returns the MIME type of the archive being uploaded. Encrypted archives are no longer in the
+// format they were compressed with, so they are uploaded as plain binary data.
+func contentType(a *Archive) string {
+	if len(a.EncryptionKey) > 0 {
+		return "application/octet-stream"
+	}
+
+	return a.Format.ContentType()
+}
+
+// Returns the largest size the archive of the included files could possibly be. This is
+// the uncompressed size of every file plus the tar headers and padding, with some room left
+// for the gzip framing in the event that the data is not compressible at all.
+func estimateArchiveSize(included *IncludedFiles) int64 {
+	var sz int64 = 1024
+	for _, p := range included.All() {
+		sz += 512
+
+		if st, err := os.Stat(p); err == nil {
+			sz += (st.Size() + 511) &^ 511
+		}
+	}
+
+	return sz + sz/100 + 1024
+}
+
+// Opens a stream to the backup stored in S3. For restorations the presigned URL must be a
+// GET endpoint for the backup object.
+func (s *S3Backup) download() (io.ReadCloser, error) {
+	if s.PresignedUrl == "" {
+		return nil, ErrMissingDownloadUrl
+	}
+
+	r, err := http.NewRequest(http.MethodGet, s.PresignedUrl, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		return nil, fmt.Errorf("failed to get S3 object, %d:%s", resp.StatusCode, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// Restores the contents of a backup stored in S3. The archive is streamed directly from the
+// bucket and never written to the local disk in its compressed form.
+func (s *S3Backup) Restore(callback RestoreCallback) error {
+	log.WithField("backup", s.Identifier()).Debug("downloading backup from remote S3 endpoint for restoration")
+
+	body, err := s.download()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return restoreFromReader(body, s.EncryptionKey, callback)
+}
+
+// Returns the contents of the backup. If the backup was generated on this node the manifest
+// stored on the disk is used, otherwise the archive is streamed from the bucket to build it.
+func (s *S3Backup) Contents() (*Manifest, error) {
+	m, err := readManifest(s.manifestPath())
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return m, err
+	}
+
+	body, err := s.download()
+	if err != nil {
 		return nil, err
-	} else {
-		r.ContentLength = sz
-		r.Header.Add("Content-Length", strconv.Itoa(int(sz)))
-		r.Header.Add("Content-Type", "application/x-gzip")
 	}
+	defer body.Close()
 
-	r.Body = rc
+	return manifestFromReader(s.Identifier(), body, s.EncryptionKey)
+}
 
-	log.WithFields(log.Fields{
-		"endpoint": s.PresignedUrl,
-		"headers":  r.Header,
-	}).Debug("uploading backup to remote S3 endpoint")
+// Verifies the integrity of a backup stored in S3 by streaming the archive from the bucket.
+func (s *S3Backup) Verify() (*ArchiveDetails, error) {
+	body, err := s.download()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
 
-	return http.DefaultClient.Do(r)
+	return s.verify(body)
 }
@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// The size of each chunk that a file is split into when it is stored in the chunk store. Files
+// are split on fixed boundaries, which works well for game world files since they are mostly
+// modified in place rather than having data inserted into the middle of them.
+const chunkSize = 4 << 20
+
+// The chunk store is shared by every incremental backup on the node, which means that identical
+// chunks are only ever written to the disk once, even across different servers.
+var chunks = &chunkStore{}
+
+// A content-addressed store of compressed file chunks that keeps track of how many times each
+// chunk is referenced by a backup manifest. A chunk is only removed from the disk once nothing
+// references it anymore.
+type chunkStore struct {
+	mu   sync.Mutex
+	refs map[string]int64
+}
+
+// Returns the directory that all of the chunks are stored within.
+func chunkDirectory() string {
+	return path.Join(config.Get().System.BackupDirectory, ".chunks")
+}
+
+// Returns the path to a specific chunk on the disk. Chunks are split into sub-directories
+// using the first two characters of their hash to avoid a single massive directory.
+func chunkPath(hash string) string {
+	return path.Join(chunkDirectory(), hash[0:2], hash)
+}
+
+// Returns the path to the file that tracks the reference count of every chunk.
+func chunkIndexPath() string {
+	return path.Join(chunkDirectory(), "index.json")
+}
+
+// Loads the reference counts from the disk if they have not already been loaded. This
+// must be called while holding the store lock.
+func (cs *chunkStore) load() error {
+	if cs.refs != nil {
+		return nil
+	}
+
+	refs := make(map[string]int64)
+	b, err := ioutil.ReadFile(chunkIndexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &refs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	cs.refs = refs
+
+	return nil
+}
+
+// Persists the current reference counts to the disk. The index is written to a temporary
+// file first and then moved into place so that a crash never leaves a partial index behind.
+// This must be called while holding the store lock.
+func (cs *chunkStore) save() error {
+	b, err := json.Marshal(cs.refs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return writeFileAtomic(chunkIndexPath(), b)
+}
+
+// Stores a chunk of data in the store if it does not already exist, and increments the number
+// of references to it. Returns the hash of the chunk that can be used to read it back, and the
+// number of bytes written to the disk, which is zero if the chunk was already stored.
+func (cs *chunkStore) Acquire(data []byte) (string, int64, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.load(); err != nil {
+		return "", 0, err
+	}
+
+	// If the chunk is already referenced by another backup there is no need to write
+	// it again, just bump the number of references.
+	if cs.refs[hash] > 0 {
+		cs.refs[hash]++
+
+		return hash, 0, nil
+	}
+
+	var buf bytes.Buffer
+	gzw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := gzw.Write(data); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+
+	if err := gzw.Close(); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(path.Dir(chunkPath(hash)), 0700); err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+
+	if err := writeFileAtomic(chunkPath(hash), buf.Bytes()); err != nil {
+		return "", 0, err
+	}
+
+	cs.refs[hash]++
+
+	return hash, int64(buf.Len()), nil
+}
+
+// Decrements the number of references for each of the chunks provided and removes any chunk
+// from the disk that is no longer referenced by any backup. The updated reference counts are
+// persisted once all of the chunks have been handled.
+func (cs *chunkStore) Release(hashes []string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.load(); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		cs.refs[hash]--
+
+		if cs.refs[hash] > 0 {
+			continue
+		}
+
+		delete(cs.refs, hash)
+		if err := os.Remove(chunkPath(hash)); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return cs.save()
+}
+
+// Persists the current reference counts to the disk.
+func (cs *chunkStore) Save() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := cs.load(); err != nil {
+		return err
+	}
+
+	return cs.save()
+}
+
+// Reads a chunk from the disk and returns the decompressed contents of it. The contents are
+// verified against the hash of the chunk to avoid restoring corrupted data.
+func (cs *chunkStore) Read(hash string) ([]byte, error) {
+	f, err := os.Open(chunkPath(hash))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer gzr.Close()
+
+	b, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != hash {
+		return nil, errors.New("backup: chunk " + hash + " failed checksum verification")
+	}
+
+	return b, nil
+}
+
+// A reader that returns the contents of a series of chunks as a single continuous stream,
+// only loading one chunk into memory at a time.
+type chunkReader struct {
+	hashes []string
+	cur    *bytes.Reader
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for cr.cur == nil || cr.cur.Len() == 0 {
+		if len(cr.hashes) == 0 {
+			return 0, io.EOF
+		}
+
+		b, err := chunks.Read(cr.hashes[0])
+		if err != nil {
+			return 0, err
+		}
+
+		cr.hashes = cr.hashes[1:]
+		cr.cur = bytes.NewReader(b)
+	}
+
+	return cr.cur.Read(p)
+}
+
+// Writes data to a temporary file in the same directory as the destination and then renames
+// it into place, ensuring the destination is never left partially written.
+func writeFileAtomic(p string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+
+		return errors.WithStack(err)
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	. "github.com/franela/goblin"
+	"github.com/pterodactyl/wings/config"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newChunkStore() (*chunkStore, string) {
+	dir, err := ioutil.TempDir(os.TempDir(), "pterodactyl")
+	if err != nil {
+		panic(err)
+	}
+
+	config.Set(&config.Configuration{
+		AuthenticationToken: "abc",
+		System: config.SystemConfiguration{
+			BackupDirectory: dir,
+		},
+	})
+
+	if err := os.MkdirAll(chunkDirectory(), 0700); err != nil {
+		panic(err)
+	}
+
+	return &chunkStore{}, dir
+}
+
+func chunkExists(hash string) bool {
+	_, err := os.Stat(chunkPath(hash))
+
+	return err == nil
+}
+
+func TestChunkStore(t *testing.T) {
+	g := Goblin(t)
+
+	var cs *chunkStore
+	var dir string
+
+	g.Describe("Acquire", func() {
+		g.BeforeEach(func() {
+			cs, dir = newChunkStore()
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("stores a chunk using the hash of its contents", func() {
+			data := []byte("test chunk content")
+			sum := sha256.Sum256(data)
+
+			hash, written, err := cs.Acquire(data)
+			g.Assert(err).IsNil()
+			g.Assert(hash).Equal(hex.EncodeToString(sum[:]))
+			g.Assert(written > 0).IsTrue()
+			g.Assert(cs.refs[hash]).Equal(int64(1))
+
+			b, err := cs.Read(hash)
+			g.Assert(err).IsNil()
+			g.Assert(bytes.Equal(b, data)).IsTrue()
+		})
+
+		g.It("does not write a chunk that is already stored", func() {
+			hash, _, err := cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+
+			dup, written, err := cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+			g.Assert(dup).Equal(hash)
+			g.Assert(written).Equal(int64(0))
+			g.Assert(cs.refs[hash]).Equal(int64(2))
+		})
+
+		g.It("persists the reference counts", func() {
+			hash, _, err := cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+
+			_, _, err = cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+
+			err = cs.Save()
+			g.Assert(err).IsNil()
+
+			loaded := &chunkStore{}
+			err = loaded.load()
+			g.Assert(err).IsNil()
+			g.Assert(loaded.refs[hash]).Equal(int64(2))
+		})
+	})
+
+	g.Describe("Release", func() {
+		g.BeforeEach(func() {
+			cs, dir = newChunkStore()
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("only removes a chunk once nothing references it", func() {
+			hash, _, err := cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+
+			_, _, err = cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+
+			err = cs.Release([]string{hash})
+			g.Assert(err).IsNil()
+			g.Assert(chunkExists(hash)).IsTrue()
+			g.Assert(cs.refs[hash]).Equal(int64(1))
+
+			err = cs.Release([]string{hash})
+			g.Assert(err).IsNil()
+			g.Assert(chunkExists(hash)).IsFalse()
+
+			_, ok := cs.refs[hash]
+			g.Assert(ok).IsFalse()
+		})
+
+		g.It("removes a chunk referenced more than once by the same backup", func() {
+			var hashes []string
+			for i := 0; i < 2; i++ {
+				hash, _, err := cs.Acquire([]byte("repeated chunk"))
+				g.Assert(err).IsNil()
+
+				hashes = append(hashes, hash)
+			}
+
+			err := cs.Release(hashes)
+			g.Assert(err).IsNil()
+			g.Assert(chunkExists(hashes[0])).IsFalse()
+		})
+
+		g.It("keeps chunks shared with another backup", func() {
+			acquire := func(data ...string) []string {
+				var out []string
+				for _, d := range data {
+					hash, _, err := cs.Acquire([]byte(d))
+					g.Assert(err).IsNil()
+
+					out = append(out, hash)
+				}
+
+				return out
+			}
+
+			first := acquire("only in first", "shared")
+			second := acquire("shared", "only in second")
+
+			err := cs.Release(first)
+			g.Assert(err).IsNil()
+			g.Assert(chunkExists(first[0])).IsFalse()
+
+			for i, d := range []string{"shared", "only in second"} {
+				b, err := cs.Read(second[i])
+				g.Assert(err).IsNil()
+				g.Assert(string(b)).Equal(d)
+			}
+
+			err = cs.Release(second)
+			g.Assert(err).IsNil()
+			g.Assert(chunkExists(second[0])).IsFalse()
+			g.Assert(chunkExists(second[1])).IsFalse()
+			g.Assert(len(cs.refs)).Equal(0)
+		})
+	})
+
+	g.Describe("Read", func() {
+		g.BeforeEach(func() {
+			cs, dir = newChunkStore()
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("rejects a chunk that does not match its hash", func() {
+			hash, _, err := cs.Acquire([]byte("test chunk content"))
+			g.Assert(err).IsNil()
+
+			other, _, err := cs.Acquire([]byte("other chunk content"))
+			g.Assert(err).IsNil()
+
+			b, err := ioutil.ReadFile(chunkPath(other))
+			g.Assert(err).IsNil()
+
+			err = ioutil.WriteFile(chunkPath(hash), b, 0600)
+			g.Assert(err).IsNil()
+
+			_, err = cs.Read(hash)
+			g.Assert(err).IsNotNil()
+		})
+	})
+}
@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"io"
+)
+
+// The name of the encryption scheme used for backups, this is reported back to the panel
+// so that it knows how a given backup was stored.
+const EncryptionSchemeAesGcm = "aes-256-gcm"
+
+// Encrypted archives are split into segments of this size, each of which is sealed on its
+// own. This allows an archive to be encrypted and decrypted as a stream without needing to
+// hold the entire thing in memory.
+const encryptionSegmentSize = 64 * 1024
+
+// Every encrypted archive begins with these bytes, followed by the random nonce prefix. This
+// allows the restore and download processes to detect an encrypted archive automatically.
+var encryptionMagic = []byte("WBE1")
+
+var ErrMissingEncryptionKey = errors.New("backup: archive is encrypted but no encryption key is available")
+
+// Returned when the start of an encrypted archive cannot be decrypted, which almost always means
+// that the archive was encrypted using a different key.
+var ErrEncryptionKeyMismatch = errors.New("backup: archive could not be decrypted using the available encryption key")
+
+const encryptionNoncePrefixSize = 7
+
+// Returns the encryption scheme that is used when the given key is present, or an empty string
+// if the backup is not being encrypted.
+func encryptionScheme(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+
+	return EncryptionSchemeAesGcm
+}
+
+// Returns the key that should be used to encrypt or decrypt a backup. A key provided by the
+// panel for the specific backup takes priority over the key configured for the node. If neither
+// is set a nil key is returned and the backup is not encrypted.
+func resolveEncryptionKey(key string) ([]byte, error) {
+	if key == "" {
+		key = config.Get().System.BackupEncryptionKey
+	}
+
+	if key == "" {
+		return nil, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: could not decode encryption key")
+	}
+
+	if len(b) != 32 {
+		return nil, errors.New("backup: encryption key must be exactly 32 bytes")
+	}
+
+	return b, nil
+}
+
+// Builds the nonce for a specific segment of the archive. The final segment is marked in the
+// nonce itself so that a truncated archive fails to decrypt instead of silently being accepted.
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return gcm, nil
+}
+
+// A writer that encrypts everything written to it before passing it along to the underlying
+// writer. Close must be called once all of the data has been written, otherwise the final
+// segment will never be written and the archive cannot be decrypted.
+type encryptedWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+func newEncryptedWriter(w io.Writer, key []byte) (*encryptedWriter, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if _, err := w.Write(append(append([]byte{}, encryptionMagic...), prefix...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &encryptedWriter{w: w, gcm: gcm, prefix: prefix}, nil
+}
+
+func (ew *encryptedWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("backup: write to closed encrypted writer")
+	}
+
+	ew.buf = append(ew.buf, p...)
+	// Only seal a segment once we know that more data follows it, the final segment is
+	// always written by Close.
+	for len(ew.buf) > encryptionSegmentSize {
+		if err := ew.seal(ew.buf[:encryptionSegmentSize], false); err != nil {
+			return 0, err
+		}
+		ew.buf = ew.buf[encryptionSegmentSize:]
+	}
+
+	return len(p), nil
+}
+
+// Writes the final segment of the archive. Calling Close more than once is a no-op.
+func (ew *encryptedWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+
+	return ew.seal(ew.buf, true)
+}
+
+func (ew *encryptedWriter) seal(p []byte, last bool) error {
+	out := ew.gcm.Seal(nil, segmentNonce(ew.prefix, ew.counter, last), p, nil)
+	ew.counter++
+
+	if _, err := ew.w.Write(out); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// A reader that decrypts an archive written by the encrypted writer.
+type decryptedReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (dr *decryptedReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+
+		if err := dr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+
+	return n, nil
+}
+
+// Reads and decrypts the next segment from the underlying reader.
+func (dr *decryptedReader) next() error {
+	seg := make([]byte, encryptionSegmentSize+dr.gcm.Overhead())
+	n, err := io.ReadFull(dr.r, seg)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("backup: encrypted archive is truncated")
+		}
+
+		return errors.WithStack(err)
+	}
+
+	// A short read means this is the last segment, otherwise check if there is any data
+	// left after this segment to determine if it is the last one.
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, perr := dr.r.Peek(1); perr == io.EOF {
+			last = true
+		}
+	}
+
+	out, err := dr.gcm.Open(nil, segmentNonce(dr.prefix, dr.counter, last), seg[:n], nil)
+	if err != nil {
+		if dr.counter == 0 {
+			return ErrEncryptionKeyMismatch
+		}
+
+		return errors.New("backup: failed to decrypt archive, the archive is corrupted")
+	}
+
+	dr.counter++
+	dr.buf = out
+	dr.done = last
+
+	return nil
+}
+
+// Determines if the archive being read by r is encrypted, without consuming any of it.
+func IsEncrypted(r *bufio.Reader) bool {
+	header, err := r.Peek(len(encryptionMagic))
+
+	return err == nil && bytes.Equal(header, encryptionMagic)
+}
+
+// Returns a reader that transparently decrypts the contents of r if it is an encrypted backup
+// archive, along with a boolean indicating if the archive was encrypted. Archives that are not
+// encrypted are returned as-is so that older backups continue to work.
+func DecryptReader(r io.Reader, key string) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	if !IsEncrypted(br) {
+		return br, false, nil
+	}
+
+	k, err := resolveEncryptionKey(key)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if k == nil {
+		return nil, true, ErrMissingEncryptionKey
+	}
+
+	gcm, err := newGcm(k)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if _, err := br.Discard(len(encryptionMagic)); err != nil {
+		return nil, true, errors.WithStack(err)
+	}
+
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, true, errors.WithStack(err)
+	}
+
+	return &decryptedReader{r: br, gcm: gcm, prefix: prefix}, true, nil
+}
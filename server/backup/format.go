@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+	"hash"
+	"io"
+	"io/ioutil"
+	"runtime"
+)
+
+type ArchiveFormat string
+
+const (
+	FormatTarGzip ArchiveFormat = "tar.gz"
+	FormatTarZstd ArchiveFormat = "tar.zst"
+	FormatTarXz   ArchiveFormat = "tar.xz"
+)
+
+// All of the archive formats that can be used when generating a backup. When locating a
+// backup on the disk each of these formats is checked in order.
+var archiveFormats = []ArchiveFormat{FormatTarGzip, FormatTarZstd, FormatTarXz}
+
+const (
+	ChecksumSha1   = "sha1"
+	ChecksumSha256 = "sha256"
+)
+
+// The checksum type used when the panel does not request a specific one.
+const DefaultChecksumType = ChecksumSha1
+
+// Returns the format to use, defaulting to tar.gz if none is set.
+func (f ArchiveFormat) orDefault() ArchiveFormat {
+	if f == "" {
+		return FormatTarGzip
+	}
+
+	return f
+}
+
+// Returns the file extension used for archives of this format.
+func (f ArchiveFormat) Extension() string {
+	return "." + string(f.orDefault())
+}
+
+// Returns the MIME type of archives of this format.
+func (f ArchiveFormat) ContentType() string {
+	switch f.orDefault() {
+	case FormatTarZstd:
+		return "application/zstd"
+	case FormatTarXz:
+		return "application/x-xz"
+	default:
+		return "application/x-gzip"
+	}
+}
+
+// Returns an error if the format is not one that wings knows how to generate.
+func (f ArchiveFormat) Validate() error {
+	for _, v := range archiveFormats {
+		if f.orDefault() == v {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("unknown archive format [%s] provided", f))
+}
+
+// Returns a new hash for the given checksum type.
+func newChecksumHash(t string) (hash.Hash, error) {
+	switch t {
+	case "", ChecksumSha1:
+		return sha1.New(), nil
+	case ChecksumSha256:
+		return sha256.New(), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unknown checksum type [%s] provided", t))
+}
+
+// Returns the checksum type to use, falling back to the default if none is set.
+func checksumTypeOrDefault(t string) string {
+	if t == "" {
+		return DefaultChecksumType
+	}
+
+	return t
+}
+
+// Returns a writer that compresses everything written to it using the given archive format
+// and compression level. A level of zero uses the default level for the format. The writer must
+// be closed to flush the archive.
+func newCompressedWriter(w io.Writer, format ArchiveFormat, level int) (io.WriteCloser, error) {
+	switch format.orDefault() {
+	case FormatTarGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		gzw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		maxCpu := runtime.NumCPU() / 2
+		if maxCpu > 4 {
+			maxCpu = 4
+		}
+		_ = gzw.SetConcurrency(1<<20, maxCpu)
+
+		return gzw, nil
+	case FormatTarZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(4)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return zw, nil
+	case FormatTarXz:
+		cfg := xz.WriterConfig{}
+		// The xz library does not have compression presets, so the level is used to scale
+		// the size of the dictionary, from 1MB at level one up to a maximum of 64MB.
+		if level > 0 {
+			if level > 7 {
+				level = 7
+			}
+			cfg.DictCap = 1 << (19 + uint(level))
+		}
+
+		xw, err := cfg.NewWriter(w)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return xw, nil
+	}
+
+	return nil, format.Validate()
+}
+
+// Returns a reader that decompresses the archive read from r. The compression format is
+// detected automatically from the first few bytes of the archive.
+func newDecompressedReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	// Archives shorter than the header are still passed along so that the error returned is
+	// about the format, but any other error reading the archive is returned as-is.
+	header, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return gzr, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return ioutil.NopCloser(xr), nil
+	}
+
+	return nil, errors.New("backup: could not detect the compression format of the archive")
+}
@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"github.com/pterodactyl/wings/api"
+	"time"
+)
+
+// Hooks are console commands that are sent to a running server around the generation of a
+// backup. They allow the server to be quiesced before the archive is created, for example by
+// disabling automatic saving and flushing the world to the disk, and then resumed again once
+// the backup has finished.
+type Hooks struct {
+	// Commands that are sent to the server before the backup is generated. If any of these
+	// fail the backup is aborted, although the post hooks will still be executed.
+	Pre []Hook `json:"pre"`
+
+	// Commands that are sent to the server once the backup has finished. These are always
+	// executed if the pre hooks were, regardless of whether or not the backup succeeded.
+	Post []Hook `json:"post"`
+
+	// The maximum number of seconds to wait for the output line of any single hook to be
+	// matched. Defaults to 60 seconds if not provided.
+	Timeout int `json:"timeout"`
+}
+
+type Hook struct {
+	// The command to send to the server console.
+	Command string `json:"command"`
+
+	// An optional line of console output to wait for after sending the command before the
+	// next hook is executed. This follows the same format as the startup done lines, and
+	// may be prefixed with "regex:" to match using a regular expression.
+	WaitFor *api.OutputLineMatcher `json:"wait_for"`
+}
+
+// Returns the amount of time to wait for the output of any single hook.
+func (h *Hooks) WaitTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return time.Second * 60
+	}
+
+	return time.Second * time.Duration(h.Timeout)
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A manifest describes every file contained within a backup. For incremental backups this
+// also includes the ordered list of chunks that need to be combined to recreate the contents
+// of each file.
+type Manifest struct {
+	Uuid      string         `json:"uuid"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []ManifestFile `json:"files"`
+	// The server and adapter that the backup was generated for, these are used to determine
+	// which backups retention policies apply to.
+	Server  string `json:"server,omitempty"`
+	Adapter string `json:"adapter,omitempty"`
+	// The checksum of the archive as reported to the panel when the backup was generated,
+	// this is used to detect an archive that has been modified or corrupted since then.
+	Checksum     string `json:"checksum,omitempty"`
+	ChecksumType string `json:"checksum_type,omitempty"`
+	// The number of bytes of chunks written to the chunk store by an incremental backup. Any
+	// chunks that were already stored by an earlier backup are not included.
+	AddedSize int64 `json:"added_size,omitempty"`
+}
+
+type ManifestFile struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	// The SHA256 hash of the contents of the file.
+	Hash   string   `json:"hash"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// Returns every chunk referenced by the manifest. A chunk is returned once for each time it
+// is referenced so that the result can be used to adjust the chunk reference counts.
+func (m *Manifest) Chunks() []string {
+	var out []string
+	for _, f := range m.Files {
+		out = append(out, f.Chunks...)
+	}
+
+	return out
+}
+
+// Writes the manifest to the given path, sorting the files by name first so that the output
+// is consistent between runs.
+func (m *Manifest) Write(p string) error {
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Name < m.Files[j].Name
+	})
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return writeFileAtomic(p, b)
+}
+
+// Reads a manifest from the disk.
+func readManifest(p string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &m, nil
+}
+
+// Returns the path to the manifest that is stored alongside an archive based backup. For S3
+// backups the manifest is kept on the node that generated the backup.
+func (b *Backup) manifestPath() string {
+	return path.Join(config.Get().System.BackupDirectory, b.Identifier()+".files.json")
+}
+
+// Normalizes the name of a file in a backup so that it can be compared against a path
+// provided by a user.
+func normalizeManifestPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// Returns a function that determines if a file in a backup matches any of the given paths.
+// A path matches the file itself, or any file within it if the path is a directory.
+func MatchPaths(paths []string) func(name string) bool {
+	var cleaned []string
+	for _, p := range paths {
+		cleaned = append(cleaned, normalizeManifestPath(p))
+	}
+
+	return func(name string) bool {
+		name = normalizeManifestPath(name)
+		for _, p := range cleaned {
+			if p == "" || name == p || strings.HasPrefix(name, p+"/") {
+				return true
+			}
+		}
+
+		return false
+	}
+}
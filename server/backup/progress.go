@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Tracks the progress of a backup as it is being generated. The totals are calculated from the
+// included files before the backup starts, and the processed counts are updated by the archiver
+// as each file is read.
+type Progress struct {
+	files      int64
+	bytes      int64
+	totalFiles int64
+	totalBytes int64
+}
+
+// Sets the totals for the progress based on the files that are being included in the backup.
+func (p *Progress) Track(included *IncludedFiles) {
+	var files, bytes int64
+	for _, f := range included.All() {
+		if st, err := os.Stat(f); err == nil && st.Mode().IsRegular() {
+			files++
+			bytes += st.Size()
+		}
+	}
+
+	atomic.StoreInt64(&p.files, 0)
+	atomic.StoreInt64(&p.bytes, 0)
+	atomic.StoreInt64(&p.totalFiles, files)
+	atomic.StoreInt64(&p.totalBytes, bytes)
+}
+
+// Returns the number of files that have been processed, and the total number of files.
+func (p *Progress) Files() (int64, int64) {
+	return atomic.LoadInt64(&p.files), atomic.LoadInt64(&p.totalFiles)
+}
+
+// Returns the number of bytes that have been processed, and the total number of bytes.
+func (p *Progress) Bytes() (int64, int64) {
+	return atomic.LoadInt64(&p.bytes), atomic.LoadInt64(&p.totalBytes)
+}
+
+func (p *Progress) addFile() {
+	if p != nil {
+		atomic.AddInt64(&p.files, 1)
+	}
+}
+
+func (p *Progress) addBytes(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.bytes, int64(n))
+	}
+}
+
+// A reader used when reading files into a backup. This tracks the progress of the backup
+// and stops reading as soon as the backup is cancelled, rather than waiting for the current
+// file to be completely read.
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress *Progress
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := pr.r.Read(b)
+	pr.progress.addBytes(n)
+
+	return n, err
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup that is stored on the disk of this node, along with the details used to determine
+// if it should be kept by the retention policy.
+type StoredBackup struct {
+	Backup    BackupInterface
+	CreatedAt time.Time
+	Size      int64
+}
+
+// Returns every local and incremental backup stored on the node for the given server, ordered
+// from newest to oldest. Backups are matched to a server using their manifest, so any backup
+// generated before the server was recorded in the manifest is never returned.
+func LocateServerBackups(server string) ([]StoredBackup, error) {
+	dir := config.Get().System.BackupDirectory
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var out []StoredBackup
+	for _, f := range files {
+		if f.IsDir() || (!strings.HasSuffix(f.Name(), ".files.json") && !strings.HasSuffix(f.Name(), ".manifest.json")) {
+			continue
+		}
+
+		m, err := readManifest(path.Join(dir, f.Name()))
+		if err != nil || m.Server != server {
+			continue
+		}
+
+		var b BackupInterface
+		switch m.Adapter {
+		case LocalBackupAdapter:
+			if lb, _, err := LocateLocal(m.Uuid); err == nil {
+				b = lb
+			}
+		case IncrementalBackupAdapter:
+			if ib, _, err := LocateIncremental(m.Uuid); err == nil {
+				b = ib
+			}
+		}
+
+		if b == nil {
+			continue
+		}
+
+		sz, err := b.Size()
+		if err != nil {
+			continue
+		}
+
+		out = append(out, StoredBackup{Backup: b, CreatedAt: m.CreatedAt, Size: sz})
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].CreatedAt.After(out[j].CreatedAt)
+	})
+
+	return out, nil
+}
+
+// Returns the backups that are not kept by the retention policy. The backups must be ordered
+// from newest to oldest, and the newest backup is never returned.
+func selectPrunedBackups(backups []StoredBackup, policy config.BackupRetentionConfiguration, now time.Time) []StoredBackup {
+	keep := make([]bool, len(backups))
+	for i := range backups {
+		keep[i] = policy.KeepLast <= 0 && policy.KeepDaily <= 0
+	}
+
+	for i := 0; i < policy.KeepLast && i < len(backups); i++ {
+		keep[i] = true
+	}
+
+	if policy.KeepDaily > 0 {
+		days := make(map[string]bool)
+		cutoff := now.AddDate(0, 0, -policy.KeepDaily)
+		for i, b := range backups {
+			day := b.CreatedAt.Local().Format("2006-01-02")
+			if b.CreatedAt.Before(cutoff) || days[day] {
+				continue
+			}
+
+			days[day] = true
+			keep[i] = true
+		}
+	}
+
+	// Once the total size of the backups being kept goes over the limit every older backup
+	// is removed, even if it would fit within the remaining space on its own.
+	if policy.MaxSize > 0 {
+		var total int64
+		var full bool
+		for i, b := range backups {
+			if !keep[i] {
+				continue
+			}
+
+			total += b.Size
+			if full || (i > 0 && total > policy.MaxSize) {
+				full = true
+				keep[i] = false
+			}
+		}
+	}
+
+	var out []StoredBackup
+	for i, b := range backups {
+		if i > 0 && !keep[i] {
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// Removes any backups for the server that are no longer kept by the retention policy, and
+// returns the UUID of each backup that was removed. If the policy does not have any rules
+// configured nothing is removed.
+func Prune(server string, policy config.BackupRetentionConfiguration) ([]string, error) {
+	if policy.KeepLast <= 0 && policy.KeepDaily <= 0 && policy.MaxSize <= 0 {
+		return nil, nil
+	}
+
+	backups, err := LocateServerBackups(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []string
+	for _, b := range selectPrunedBackups(backups, policy, time.Now()) {
+		if err := b.Backup.Remove(); err != nil {
+			// Another process may have already removed the backup, in which case there is
+			// nothing left to do for it.
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"backup": b.Backup.Identifier(),
+				"server": server,
+				"error":  err,
+			}).Warn("failed to remove backup while applying retention policy")
+
+			continue
+		}
+
+		pruned = append(pruned, b.Backup.Identifier())
+	}
+
+	return pruned, nil
+}
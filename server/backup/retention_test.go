@@ -0,0 +1,124 @@
+package backup
+
+import (
+	. "github.com/franela/goblin"
+	"github.com/pterodactyl/wings/config"
+	"testing"
+	"time"
+)
+
+func storedBackup(uuid string, incremental bool, created time.Time, size int64) StoredBackup {
+	var b BackupInterface = &LocalBackup{Backup{Uuid: uuid}}
+	if incremental {
+		b = &IncrementalBackup{Backup{Uuid: uuid}}
+	}
+
+	return StoredBackup{Backup: b, CreatedAt: created, Size: size}
+}
+
+func TestSelectPrunedBackups(t *testing.T) {
+	g := Goblin(t)
+
+	now := time.Date(2021, 1, 10, 12, 0, 0, 0, time.Local)
+	at := func(day int, hour int) time.Time {
+		return time.Date(2021, 1, day, hour, 0, 0, 0, time.Local)
+	}
+
+	cases := []struct {
+		name    string
+		policy  config.BackupRetentionConfiguration
+		backups []StoredBackup
+		pruned  []string
+	}{
+		{
+			name:   "keeps every backup when no rules are configured",
+			policy: config.BackupRetentionConfiguration{},
+			backups: []StoredBackup{
+				storedBackup("a", false, at(10, 10), 100),
+				storedBackup("b", false, at(9, 10), 100),
+			},
+		},
+		{
+			name:   "keeps the most recent backups",
+			policy: config.BackupRetentionConfiguration{KeepLast: 2},
+			backups: []StoredBackup{
+				storedBackup("a", false, at(10, 10), 100),
+				storedBackup("b", true, at(10, 8), 5),
+				storedBackup("c", true, at(9, 10), 5),
+				storedBackup("d", false, at(8, 10), 100),
+			},
+			pruned: []string{"c", "d"},
+		},
+		{
+			name:   "keeps the most recent backup of each day",
+			policy: config.BackupRetentionConfiguration{KeepDaily: 2},
+			backups: []StoredBackup{
+				storedBackup("a", true, at(10, 10), 5),
+				storedBackup("b", true, at(10, 8), 5),
+				storedBackup("c", true, at(9, 20), 5),
+				storedBackup("d", true, at(9, 8), 5),
+				storedBackup("e", true, at(7, 10), 5),
+			},
+			pruned: []string{"b", "d", "e"},
+		},
+		{
+			name:   "keeps backups matching either rule",
+			policy: config.BackupRetentionConfiguration{KeepLast: 2, KeepDaily: 2},
+			backups: []StoredBackup{
+				storedBackup("a", false, at(10, 10), 100),
+				storedBackup("b", false, at(10, 8), 100),
+				storedBackup("c", false, at(10, 6), 100),
+				storedBackup("d", false, at(9, 10), 100),
+				storedBackup("e", false, at(6, 10), 100),
+			},
+			pruned: []string{"c", "e"},
+		},
+		{
+			name:   "removes the oldest kept backups once over the size limit",
+			policy: config.BackupRetentionConfiguration{KeepLast: 4, MaxSize: 250},
+			backups: []StoredBackup{
+				storedBackup("a", false, at(10, 10), 100),
+				storedBackup("b", false, at(10, 8), 100),
+				storedBackup("c", false, at(9, 10), 100),
+				storedBackup("d", false, at(8, 10), 100),
+			},
+			pruned: []string{"c", "d"},
+		},
+		{
+			name:   "removes every older backup once the size limit is reached",
+			policy: config.BackupRetentionConfiguration{MaxSize: 100},
+			backups: []StoredBackup{
+				storedBackup("a", true, at(10, 10), 50),
+				storedBackup("b", true, at(10, 8), 10),
+				storedBackup("c", true, at(9, 10), 10),
+				storedBackup("d", false, at(8, 10), 500),
+				storedBackup("e", true, at(7, 10), 10),
+			},
+			pruned: []string{"d", "e"},
+		},
+		{
+			name:   "always keeps the newest backup",
+			policy: config.BackupRetentionConfiguration{MaxSize: 100},
+			backups: []StoredBackup{
+				storedBackup("a", false, at(10, 10), 500),
+				storedBackup("b", true, at(9, 10), 10),
+			},
+			pruned: []string{"b"},
+		},
+	}
+
+	g.Describe("selectPrunedBackups", func() {
+		for _, c := range cases {
+			c := c
+
+			g.It(c.name, func() {
+				var pruned []string
+				for _, b := range selectPrunedBackups(c.backups, c.policy, now) {
+					pruned = append(pruned, b.Backup.Identifier())
+				}
+
+				g.Assert(pruned).Equal(c.pruned)
+			})
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/api"
+	"github.com/pterodactyl/wings/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned when the integrity of a backup could not be checked, because it is encrypted using a
+// key that is not available and there is no checksum recorded for it to compare against. This is
+// not a sign that anything is wrong with the backup itself.
+var ErrBackupUnverifiable = errors.New("backup: archive could not be decrypted and has no recorded checksum to verify it against")
+
+// Reads through an entire backup archive, calculating the checksum of it and confirming that
+// every file contained within it decompresses cleanly. If a manifest was stored alongside the
+// backup the checksum and the contents of each file are compared against it as well.
+//
+// Archives that are encrypted can only be fully walked if the key is available, otherwise only
+// the checksum of the archive is checked. If there is no checksum to check either the backup
+// cannot be verified at all.
+func (b *Backup) verify(r io.Reader) (*ArchiveDetails, error) {
+	m, err := readManifest(b.manifestPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	t := b.ChecksumType
+	if t == "" && m != nil {
+		t = m.ChecksumType
+	}
+
+	h, err := newChecksumHash(t)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make(map[string]string)
+	if m != nil {
+		for _, f := range m.Files {
+			expected[normalizeManifestPath(f.Name)] = f.Hash
+		}
+	}
+
+	var p Progress
+	cr := &progressReader{ctx: context.Background(), r: io.TeeReader(r, h), progress: &p}
+
+	err = walkArchive(cr, b.EncryptionKey, func(header *tar.Header, r io.Reader) error {
+		if !header.FileInfo().Mode().IsRegular() {
+			return nil
+		}
+
+		fh := sha256.New()
+		if _, err := io.Copy(fh, r); err != nil {
+			return errors.WithStack(err)
+		}
+
+		name := normalizeManifestPath(header.Name)
+		if hash, ok := expected[name]; ok {
+			if hash != "" && hash != hex.EncodeToString(fh.Sum(nil)) {
+				return errors.New(fmt.Sprintf("backup: contents of file [%s] do not match the manifest", header.Name))
+			}
+
+			delete(expected, name)
+		}
+
+		return nil
+	})
+
+	encrypted := errors.Is(err, ErrMissingEncryptionKey) || errors.Is(err, ErrEncryptionKeyMismatch)
+	if err != nil && !encrypted {
+		return nil, err
+	}
+
+	// Make sure the rest of the archive is read so that the checksum covers the entire thing,
+	// the tar reader stops as soon as it reaches the end of the archive.
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	size, _ := p.Bytes()
+	ad := &ArchiveDetails{
+		Checksum:     hex.EncodeToString(h.Sum(nil)),
+		ChecksumType: checksumTypeOrDefault(t),
+		Size:         size,
+	}
+
+	checked := m != nil && m.Checksum != "" && checksumTypeOrDefault(m.ChecksumType) == ad.ChecksumType
+	if checked && m.Checksum != ad.Checksum {
+		return ad, errors.New("backup: checksum of the archive does not match the checksum recorded when it was generated")
+	}
+
+	if encrypted && !checked {
+		return ad, ErrBackupUnverifiable
+	}
+
+	if m == nil {
+		return ad, nil
+	}
+
+	if !encrypted && len(expected) > 0 {
+		return ad, errors.New(fmt.Sprintf("backup: archive is missing %d file(s) listed in the manifest", len(expected)))
+	}
+
+	return ad, nil
+}
+
+// Verifies the integrity of a backup and reports the result to the panel. The error returned
+// is the reason the backup failed verification, failing to notify the panel is only logged.
+func VerifyAndNotify(b BackupInterface) error {
+	ad, err := b.Verify()
+	notifyVerification(b, ad, err)
+
+	return err
+}
+
+// The result of the last periodic verification of each backup on the node. This allows the
+// periodic verification to only notify the panel when something has changed.
+var verified = struct {
+	sync.Mutex
+	results map[string]bool
+}{results: make(map[string]bool)}
+
+// Verifies the integrity of a backup as part of the periodic verification. The panel is only
+// notified when the backup fails verification, or when it passes after previously failing. A
+// backup that cannot be verified is never reported, since nothing is known to be wrong with it.
+func verifyStoredBackup(b BackupInterface) error {
+	ad, err := b.Verify()
+	if errors.Is(err, ErrBackupUnverifiable) {
+		return err
+	}
+
+	verified.Lock()
+	previous, ok := verified.results[b.Identifier()]
+	verified.results[b.Identifier()] = err == nil
+	verified.Unlock()
+
+	if err != nil || (ok && !previous) {
+		notifyVerification(b, ad, err)
+	}
+
+	return err
+}
+
+// Reports the result of verifying a backup to the panel. Failing to notify the panel is only
+// logged.
+func notifyVerification(b BackupInterface, ad *ArchiveDetails, err error) {
+	data := api.BackupVerificationRequest{
+		Successful:   err == nil,
+		Unverifiable: errors.Is(err, ErrBackupUnverifiable),
+	}
+	if ad != nil {
+		data.Checksum = ad.Checksum
+		data.ChecksumType = ad.ChecksumType
+	}
+
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	if nerr := api.New().SendBackupVerificationStatus(b.Identifier(), data); nerr != nil {
+		log.WithFields(log.Fields{
+			"backup": b.Identifier(),
+			"error":  nerr,
+		}).Warn("failed to notify panel of backup verification status")
+	}
+}
+
+// Verifies every backup that is stored on the disk of this node. S3 backups are skipped since
+// they can only be read using a presigned URL provided by the panel. Backups that continue to
+// pass verification are not reported to the panel.
+func VerifyStoredBackups() {
+	files, err := ioutil.ReadDir(config.Get().System.BackupDirectory)
+	if err != nil {
+		log.WithField("error", err).Error("failed to read backup directory for verification")
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		var b BackupInterface
+		if strings.HasSuffix(f.Name(), ".manifest.json") {
+			if ib, _, err := LocateIncremental(strings.TrimSuffix(f.Name(), ".manifest.json")); err == nil {
+				b = ib
+			}
+		} else {
+			for _, format := range archiveFormats {
+				if strings.HasSuffix(f.Name(), format.Extension()) {
+					if lb, _, err := LocateLocal(strings.TrimSuffix(f.Name(), format.Extension())); err == nil {
+						loadEncryptionKey(lb)
+						b = lb
+					}
+					break
+				}
+			}
+		}
+
+		if b == nil {
+			continue
+		}
+
+		if err := verifyStoredBackup(b); err != nil {
+			l := log.WithFields(log.Fields{"backup": b.Identifier(), "error": err})
+			if errors.Is(err, ErrBackupUnverifiable) {
+				l.Debug("skipping verification of backup that cannot be decrypted")
+			} else {
+				l.Warn("backup failed integrity verification")
+			}
+		}
+	}
+}
+
+// Sets the key used to encrypt a backup that is stored on the disk. Backups can be encrypted with a
+// key that is specific to them, which only the panel knows, so it is requested from the panel if
+// the archive is encrypted. If the key cannot be retrieved the key configured for the node is used.
+func loadEncryptionKey(b *LocalBackup) {
+	f, err := os.Open(b.Path())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if !IsEncrypted(bufio.NewReader(f)) {
+		return
+	}
+
+	key, err := api.New().GetBackupEncryptionKey(b.Identifier())
+	if err != nil {
+		log.WithFields(log.Fields{"backup": b.Identifier(), "error": err}).Warn("failed to retrieve encryption key for backup from the panel")
+		return
+	}
+
+	b.EncryptionKey = key
+}
+
+// Verifies every backup stored on the node at the given interval. This blocks forever and
+// should be run in its own go-routine.
+func VerifyPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		log.Debug("verifying the integrity of all backups stored on the node")
+
+		VerifyStoredBackups()
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"github.com/pterodactyl/wings/config"
+	"sync"
+)
+
+// The queue shared by every server on the node that limits the number of backups which can
+// be generated at the same time.
+var backupQueue = &BackupQueue{}
+
+type queuedBackup struct {
+	server *Server
+	uuid   string
+	ready  chan bool
+}
+
+// A first-in first-out queue of backups waiting to be generated. Only a configured number of
+// backups may run at once, any others wait in the queue until a running backup finishes.
+type BackupQueue struct {
+	mu      sync.Mutex
+	running int
+	waiting []*queuedBackup
+}
+
+// Returns the maximum number of backups that can be running at once.
+func (q *BackupQueue) limit() int {
+	return config.Get().System.Backups.ConcurrentJobs
+}
+
+// Blocks until the backup is allowed to run. While waiting, the server is notified of the
+// backup's position in the queue every time it changes. The returned function must be called
+// once the backup is finished to allow the next backup in the queue to start. If the context
+// is cancelled while waiting the backup is removed from the queue and an error is returned.
+func (q *BackupQueue) Acquire(ctx context.Context, s *Server, uuid string) (func(), error) {
+	q.mu.Lock()
+	if len(q.waiting) == 0 && (q.limit() <= 0 || q.running < q.limit()) {
+		q.running++
+		q.mu.Unlock()
+
+		return q.release, nil
+	}
+
+	qb := &queuedBackup{server: s, uuid: uuid, ready: make(chan bool, 1)}
+	q.waiting = append(q.waiting, qb)
+	q.publishPositions()
+	q.mu.Unlock()
+
+	s.Log().WithField("backup", uuid).Info("backup has been queued, waiting for other backups on the node to complete")
+
+	select {
+	case <-qb.ready:
+		return q.release, nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, w := range q.waiting {
+		if w == qb {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.publishPositions()
+
+			return nil, ctx.Err()
+		}
+	}
+
+	// The backup was started at the same time that it was cancelled, give the slot back
+	// so that the next backup in the queue can run.
+	q.running--
+	q.dispatch()
+
+	return nil, ctx.Err()
+}
+
+// Marks a running backup as complete and starts as many of the queued backups as the limit
+// currently allows.
+func (q *BackupQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running--
+	q.dispatch()
+}
+
+// Starts queued backups until the concurrency limit is reached. This must be called while
+// holding the queue lock.
+func (q *BackupQueue) dispatch() {
+	var started bool
+	for len(q.waiting) > 0 && (q.limit() <= 0 || q.running < q.limit()) {
+		qb := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		started = true
+
+		qb.ready <- true
+	}
+
+	if started {
+		q.publishPositions()
+	}
+}
+
+// Emits the position of every queued backup to its server. This must be called while holding
+// the queue lock.
+func (q *BackupQueue) publishPositions() {
+	for i, qb := range q.waiting {
+		qb.server.Events().PublishJson(BackupQueuedEvent+":"+qb.uuid, map[string]interface{}{
+			"uuid":     qb.uuid,
+			"position": i + 1,
+			"total":    len(q.waiting),
+		})
+	}
+}
@@ -4,6 +4,7 @@ import "github.com/pkg/errors"
 
 var ErrIsRunning = errors.New("server is running")
 var ErrSuspended = errors.New("server is currently in a suspended state")
+var ErrIsRestoring = errors.New("server is currently restoring a backup")
 
 type crashTooFrequent struct {
 }
@@ -7,14 +7,20 @@ import (
 // Defines all of the possible output events for a server.
 // noinspection GoNameStartsWithPackageName
 const (
-	DaemonMessageEvent    = "daemon message"
-	InstallOutputEvent    = "install output"
-	InstallStartedEvent   = "install started"
-	InstallCompletedEvent = "install completed"
-	ConsoleOutputEvent    = "console output"
-	StatusEvent           = "status"
-	StatsEvent            = "stats"
-	BackupCompletedEvent  = "backup completed"
+	DaemonMessageEvent          = "daemon message"
+	InstallOutputEvent          = "install output"
+	InstallStartedEvent         = "install started"
+	InstallCompletedEvent       = "install completed"
+	ConsoleOutputEvent          = "console output"
+	StatusEvent                 = "status"
+	StatsEvent                  = "stats"
+	BackupCompletedEvent        = "backup completed"
+	BackupRestoreCompletedEvent = "backup restore completed"
+	BackupQueuedEvent           = "backup queued"
+	BackupProgressEvent         = "backup progress"
+	TransferProgressEvent       = "transfer progress"
+	SftpBlockedEvent            = "sftp blocked"
+	SftpActivityEvent           = "sftp activity"
 )
 
 // Returns the server's emitter instance.
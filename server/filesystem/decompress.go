@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/mholt/archiver/v3"
 	"github.com/pkg/errors"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -108,3 +109,119 @@ func (fs *Filesystem) DecompressFile(dir string, file string) error {
 
 	return nil
 }
+
+// Writes a single file being read out of an archive stream to the server data directory. The
+// path is resolved using SafePath to prevent a zip-slip attack from writing outside of the data
+// directory, and the size of the file is checked against the remaining disk space for the server
+// before anything is written.
+func (fs *Filesystem) ExtractFile(p string, size int64, r io.Reader) error {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var currentSize int64
+	if st, err := os.Stat(cleaned); err != nil {
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	} else if st.IsDir() {
+		return ErrIsDirectory
+	} else {
+		currentSize = st.Size()
+	}
+
+	if err := fs.HasSpaceFor(size - currentSize); err != nil {
+		return err
+	}
+
+	return fs.Writefile(cleaned, r)
+}
+
+// Extracts a single entry read out of an archive stream to the server data directory. Regular
+// files are written using ExtractFile and keep the permissions they were archived with, and
+// directories are created. Symlinks are recreated as long as they point to somewhere within the
+// data directory. Any other type of entry, or a symlink pointing outside of the data directory,
+// returns ErrUnsupportedArchiveEntry without anything being written.
+func (fs *Filesystem) ExtractEntry(header *tar.Header, r io.Reader) error {
+	mode := header.FileInfo().Mode()
+
+	switch {
+	case mode.IsRegular():
+		if err := fs.ExtractFile(header.Name, header.Size, r); err != nil {
+			return err
+		}
+
+		return fs.Chmod(header.Name, mode.Perm())
+	case mode.IsDir():
+		cleaned, err := fs.SafePath(header.Name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := os.MkdirAll(cleaned, 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := fs.Chown(header.Name); err != nil {
+			return err
+		}
+
+		return fs.Chmod(header.Name, mode.Perm())
+	case mode&os.ModeSymlink != 0:
+		return fs.extractSymlink(header.Name, header.Linkname)
+	}
+
+	return errors.WithStack(ErrUnsupportedArchiveEntry)
+}
+
+// Creates a symlink at p pointing to the target. The target is resolved relative to the
+// directory containing the symlink, and must be within the server data directory.
+func (fs *Filesystem) extractSymlink(p string, target string) error {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if filepath.IsAbs(target) {
+		return errors.Wrap(ErrUnsupportedArchiveEntry, "symlink target is an absolute path")
+	}
+
+	// The target is joined onto the directory relative to the server root so that any leading
+	// "../" segments escaping the root are caught, rather than being trimmed away by SafePath.
+	dir, err := filepath.Rel(fs.Path(), filepath.Dir(cleaned))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resolved := filepath.Join(dir, target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return errors.Wrap(ErrUnsupportedArchiveEntry, "symlink target is outside of the server data directory")
+	}
+
+	if _, err := fs.SafePath(resolved); err != nil {
+		return errors.Wrap(ErrUnsupportedArchiveEntry, "symlink target is outside of the server data directory")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cleaned), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Replace anything that is already at the location of the symlink, the same as a file
+	// being restored would, but never an entire directory.
+	if st, err := os.Lstat(cleaned); err == nil {
+		if st.IsDir() {
+			return errors.WithStack(ErrIsDirectory)
+		}
+
+		if err := os.Remove(cleaned); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := os.Symlink(target, cleaned); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -11,6 +11,7 @@ var ErrIsDirectory = errors.New("filesystem: is a directory")
 var ErrNotEnoughDiskSpace = errors.New("filesystem: not enough disk space")
 var ErrBadPathResolution = errors.New("filesystem: invalid path resolution")
 var ErrUnknownArchiveFormat = errors.New("filesystem: unknown archive format")
+var ErrUnsupportedArchiveEntry = errors.New("filesystem: archive entry cannot be extracted")
 
 // Generates an error logger instance with some basic information.
 func (fs *Filesystem) error(err error) *log.Entry {
@@ -16,6 +16,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -110,7 +112,7 @@ func (fs *Filesystem) Writefile(p string, r io.Reader) error {
 	// Check that the new size we're writing to the disk can fit. If there is currently a file
 	// we'll subtract that current file size from the size of the buffer to determine the amount
 	// of new data we're writing (or amount we're removing if smaller).
-	if err := fs.hasSpaceFor(int64(br.Size()) - currentSize); err != nil {
+	if err := fs.HasSpaceFor(int64(br.Size()) - currentSize); err != nil {
 		return err
 	}
 
@@ -178,6 +180,117 @@ func (fs *Filesystem) Rename(from string, to string) error {
 	return os.Rename(cleanedFrom, cleanedTo)
 }
 
+// Moves a file from outside of the server data directory into it at p, replacing any file that
+// already exists there. The difference in size between the two files is checked against the
+// disk space available to the server. If the file cannot be renamed into place, such as when
+// the source is on a different device, it is copied instead. The mode of the source file is kept.
+func (fs *Filesystem) ReplaceFile(p string, src string) error {
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	st, err := os.Stat(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var currentSize int64
+	if cst, err := os.Stat(cleaned); err != nil {
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	} else if cst.IsDir() {
+		return ErrIsDirectory
+	} else {
+		currentSize = cst.Size()
+	}
+
+	if err := fs.HasSpaceFor(st.Size() - currentSize); err != nil {
+		return err
+	}
+
+	// Find the first of the parent directories that does not exist yet, so that only the
+	// directories created for this file need to be chowned.
+	created := ""
+	for d := filepath.Dir(cleaned); d != fs.Path() && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		created = d
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cleaned), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if created != "" {
+		if err := fs.Chown(created); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(src, cleaned); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return errors.WithStack(err)
+		}
+
+		if err := copyFile(src, cleaned, st.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	fs.addDisk(st.Size() - currentSize)
+
+	return fs.Chown(cleaned)
+}
+
+// Copies the contents of a file to dst, creating or truncating it, and then removes the
+// original file.
+func copyFile(src string, dst string, mode os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// The mode is only applied by OpenFile when the file is created, so it is set again in case
+	// an existing file was replaced.
+	if err := w.Chmod(mode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := w.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Remove(src))
+}
+
+// Sets the mode of a single file or directory within the server data directory.
+func (fs *Filesystem) Chmod(path string, mode os.FileMode) error {
+	cleaned, err := fs.SafePath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.Chmod(cleaned, mode); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
 // Recursively iterates over a file or directory and sets the permissions on all of the
 // underlying files. Iterate over all of the files and directories. If it is a file just
 // go ahead and perform the chown operation. Otherwise dig deeper into the directory until
@@ -281,7 +394,7 @@ func (fs *Filesystem) Copy(p string) error {
 	}
 
 	// Check that copying this file wouldn't put the server over its limit.
-	if err := fs.hasSpaceFor(s.Size()); err != nil {
+	if err := fs.HasSpaceFor(s.Size()); err != nil {
 		return err
 	}
 
@@ -355,6 +468,26 @@ func (fs *Filesystem) Delete(p string) error {
 	return os.RemoveAll(resolved)
 }
 
+// Removes all of the files and folders within the server's root data directory while leaving
+// the directory itself in place. This is used when restoring a backup to a server so that
+// files not present in the backup do not linger around afterwards.
+func (fs *Filesystem) TruncateRootDirectory() error {
+	files, err := ioutil.ReadDir(fs.Path())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, f := range files {
+		if err := os.RemoveAll(filepath.Join(fs.Path(), f.Name())); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	atomic.StoreInt64(&fs.diskUsed, 0)
+
+	return nil
+}
+
 type fileOpener struct {
 	busy uint
 }
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"archive/tar"
 	"bytes"
 	"errors"
 	. "github.com/franela/goblin"
@@ -786,3 +787,252 @@ func TestFilesystem_Delete(t *testing.T) {
 		})
 	})
 }
+
+func TestFilesystem_TruncateRootDirectory(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("TruncateRootDirectory", func() {
+		g.It("removes all files and directories within the root directory", func() {
+			err := os.MkdirAll(filepath.Join(rfs.root, "/server/foo/bar"), 0755)
+			g.Assert(err).IsNil()
+
+			err = rfs.CreateServerFile("source.txt", "test content")
+			g.Assert(err).IsNil()
+
+			err = rfs.CreateServerFile("foo/bar/source.txt", "test content")
+			g.Assert(err).IsNil()
+
+			atomic.StoreInt64(&fs.diskUsed, int64(utf8.RuneCountInString("test content")*2))
+
+			err = fs.TruncateRootDirectory()
+			g.Assert(err).IsNil()
+			g.Assert(atomic.LoadInt64(&fs.diskUsed)).Equal(int64(0))
+
+			files, err := ioutil.ReadDir(filepath.Join(rfs.root, "/server"))
+			g.Assert(err).IsNil()
+			g.Assert(len(files)).Equal(0)
+		})
+
+		g.It("does not remove files outside the root directory", func() {
+			err := rfs.CreateServerFile("/../ext-source.txt", "external content")
+			g.Assert(err).IsNil()
+
+			err = fs.TruncateRootDirectory()
+			g.Assert(err).IsNil()
+
+			_, err = os.Stat(filepath.Join(rfs.root, "ext-source.txt"))
+			g.Assert(err).IsNil()
+		})
+
+		g.AfterEach(func() {
+			rfs.reset()
+
+			atomic.StoreInt64(&fs.diskUsed, 0)
+		})
+	})
+}
+
+func TestFilesystem_ExtractFile(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("ExtractFile", func() {
+		g.It("writes the file to the server directory", func() {
+			r := bytes.NewReader([]byte("test file content"))
+
+			err := fs.ExtractFile("foo/test.txt", int64(r.Len()), r)
+			g.Assert(err).IsNil()
+
+			b, err := ioutil.ReadFile(filepath.Join(rfs.root, "/server/foo/test.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("test file content")
+		})
+
+		g.It("cannot write a file outside the root directory", func() {
+			r := bytes.NewReader([]byte("test file content"))
+
+			err := fs.ExtractFile("../../test.txt", int64(r.Len()), r)
+			g.Assert(err).IsNotNil()
+			g.Assert(errors.Is(err, ErrBadPathResolution)).IsTrue()
+		})
+
+		g.It("cannot write a file that exceeds the disk limit", func() {
+			atomic.StoreInt64(&fs.diskLimit, 1024)
+
+			b := make([]byte, 1025)
+			_, err := rand.Read(b)
+			g.Assert(err).IsNil()
+
+			r := bytes.NewReader(b)
+			err = fs.ExtractFile("test.txt", int64(r.Len()), r)
+			g.Assert(err).IsNotNil()
+			g.Assert(errors.Is(err, ErrNotEnoughDiskSpace)).IsTrue()
+
+			_, err = rfs.StatServerFile("test.txt")
+			g.Assert(errors.Is(err, os.ErrNotExist)).IsTrue()
+		})
+
+		g.AfterEach(func() {
+			rfs.reset()
+
+			atomic.StoreInt64(&fs.diskUsed, 0)
+			atomic.StoreInt64(&fs.diskLimit, 0)
+		})
+	})
+}
+
+func TestFilesystem_ExtractEntry(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("ExtractEntry", func() {
+		g.It("keeps the mode of a file", func() {
+			r := bytes.NewReader([]byte("#!/bin/sh"))
+			h := &tar.Header{Typeflag: tar.TypeReg, Name: "start.sh", Size: int64(r.Len()), Mode: 0750}
+
+			err := fs.ExtractEntry(h, r)
+			g.Assert(err).IsNil()
+
+			st, err := rfs.StatServerFile("start.sh")
+			g.Assert(err).IsNil()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0750))
+		})
+
+		g.It("creates a directory", func() {
+			h := &tar.Header{Typeflag: tar.TypeDir, Name: "foo/bar/", Mode: 0700}
+
+			err := fs.ExtractEntry(h, bytes.NewReader(nil))
+			g.Assert(err).IsNil()
+
+			st, err := rfs.StatServerFile("foo/bar")
+			g.Assert(err).IsNil()
+			g.Assert(st.IsDir()).IsTrue()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0700))
+		})
+
+		g.It("creates a symlink pointing within the root directory", func() {
+			err := rfs.CreateServerFile("server.jar", "jar content")
+			g.Assert(err).IsNil()
+
+			h := &tar.Header{Typeflag: tar.TypeSymlink, Name: "libs/server.jar", Linkname: "../server.jar"}
+
+			err = fs.ExtractEntry(h, bytes.NewReader(nil))
+			g.Assert(err).IsNil()
+
+			target, err := os.Readlink(filepath.Join(rfs.root, "/server/libs/server.jar"))
+			g.Assert(err).IsNil()
+			g.Assert(target).Equal("../server.jar")
+		})
+
+		g.It("does not create a symlink pointing outside the root directory", func() {
+			for _, link := range []string{"../../malicious.txt", "/etc/passwd"} {
+				h := &tar.Header{Typeflag: tar.TypeSymlink, Name: "libs/link", Linkname: link}
+
+				err := fs.ExtractEntry(h, bytes.NewReader(nil))
+				g.Assert(err).IsNotNil()
+				g.Assert(errors.Is(err, ErrUnsupportedArchiveEntry)).IsTrue()
+
+				_, err = os.Lstat(filepath.Join(rfs.root, "/server/libs/link"))
+				g.Assert(errors.Is(err, os.ErrNotExist)).IsTrue()
+			}
+		})
+
+		g.It("does not extract other types of entries", func() {
+			h := &tar.Header{Typeflag: tar.TypeFifo, Name: "pipe"}
+
+			err := fs.ExtractEntry(h, bytes.NewReader(nil))
+			g.Assert(err).IsNotNil()
+			g.Assert(errors.Is(err, ErrUnsupportedArchiveEntry)).IsTrue()
+		})
+
+		g.AfterEach(func() {
+			rfs.reset()
+		})
+	})
+}
+
+func TestFilesystem_ReplaceFile(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	createSource := func(c string) string {
+		src := filepath.Join(rfs.root, "source.txt")
+		if err := ioutil.WriteFile(src, []byte(c), 0600); err != nil {
+			panic(err)
+		}
+
+		return src
+	}
+
+	g.Describe("ReplaceFile", func() {
+		g.It("moves the file into the server directory", func() {
+			src := createSource("replaced content")
+
+			err := fs.ReplaceFile("foo/bar/test.txt", src)
+			g.Assert(err).IsNil()
+
+			b, err := ioutil.ReadFile(filepath.Join(rfs.root, "/server/foo/bar/test.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("replaced content")
+
+			st, err := rfs.StatServerFile("foo/bar/test.txt")
+			g.Assert(err).IsNil()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0600))
+
+			_, err = os.Stat(src)
+			g.Assert(errors.Is(err, os.ErrNotExist)).IsTrue()
+		})
+
+		g.It("only checks the change in size against the disk limit", func() {
+			err := rfs.CreateServerFile("test.txt", string(make([]byte, 1000)))
+			g.Assert(err).IsNil()
+
+			atomic.StoreInt64(&fs.diskUsed, 1000)
+			atomic.StoreInt64(&fs.diskLimit, 1024)
+
+			err = fs.ReplaceFile("test.txt", createSource(string(make([]byte, 1020))))
+			g.Assert(err).IsNil()
+			g.Assert(atomic.LoadInt64(&fs.diskUsed)).Equal(int64(1020))
+
+			err = fs.ReplaceFile("test.txt", createSource(string(make([]byte, 1025))))
+			g.Assert(err).IsNotNil()
+			g.Assert(errors.Is(err, ErrNotEnoughDiskSpace)).IsTrue()
+		})
+
+		g.It("copies the file over an existing file when it cannot be renamed", func() {
+			err := rfs.CreateServerFile("test.txt", "existing content that is longer")
+			g.Assert(err).IsNil()
+
+			src := createSource("copied content")
+			dst := filepath.Join(rfs.root, "/server/test.txt")
+
+			err = copyFile(src, dst, 0750)
+			g.Assert(err).IsNil()
+
+			b, err := ioutil.ReadFile(dst)
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("copied content")
+
+			st, err := os.Stat(dst)
+			g.Assert(err).IsNil()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0750))
+
+			_, err = os.Stat(src)
+			g.Assert(errors.Is(err, os.ErrNotExist)).IsTrue()
+		})
+
+		g.It("cannot replace a file outside the root directory", func() {
+			err := fs.ReplaceFile("../test.txt", createSource("content"))
+			g.Assert(err).IsNotNil()
+			g.Assert(errors.Is(err, ErrBadPathResolution)).IsTrue()
+		})
+
+		g.AfterEach(func() {
+			rfs.reset()
+
+			atomic.StoreInt64(&fs.diskUsed, 0)
+			atomic.StoreInt64(&fs.diskLimit, 0)
+		})
+	})
+}
@@ -102,6 +102,12 @@ func (s *Server) HandlePowerAction(action PowerAction, waitSeconds ...int) error
 		}
 	}
 
+	// Don't allow the server process to be started while a backup is being restored, the files
+	// would be changing underneath the running process.
+	if action.IsStart() && s.IsRestoring() {
+		return ErrIsRestoring
+	}
+
 	switch action {
 	case PowerActionStart:
 		if s.GetState() != environment.ProcessOfflineState {
@@ -11,6 +11,7 @@ import (
 	"github.com/pterodactyl/wings/environment/docker"
 	"github.com/pterodactyl/wings/events"
 	"github.com/pterodactyl/wings/server/filesystem"
+	"github.com/pterodactyl/wings/system"
 	"golang.org/x/sync/semaphore"
 	"strings"
 	"sync"
@@ -52,6 +53,15 @@ type Server struct {
 	// installer process is still running.
 	installer InstallerDetails
 
+	// Tracks if a backup is currently being restored to this server. While this is true
+	// the server process cannot be started.
+	restoring system.AtomicBool
+
+	// The cancel functions for any backups currently being generated for this server,
+	// keyed by the UUID of the backup.
+	backupJobs   map[string]context.CancelFunc
+	backupJobsMu sync.Mutex
+
 	// The console throttler instance used to control outputs.
 	throttler *ConsoleThrottler
 
@@ -182,6 +192,23 @@ func (s *Server) IsSuspended() bool {
 	return s.Config().Suspended
 }
 
+// Checks if a backup is currently being restored to the server.
+func (s *Server) IsRestoring() bool {
+	return s.restoring.Get()
+}
+
+// Marks the server as currently restoring a backup, or finished restoring one.
+func (s *Server) SetRestoring(state bool) {
+	s.restoring.Set(state)
+}
+
+// Marks the server as restoring a backup, returning false if a backup was already being
+// restored. Only one caller can mark the server at a time, so this should be used rather
+// than calling IsRestoring and SetRestoring separately.
+func (s *Server) StartRestoring() bool {
+	return s.restoring.SwapIf(true)
+}
+
 func (s *Server) ProcessConfiguration() *api.ProcessConfiguration {
 	s.RLock()
 	defer s.RUnlock()
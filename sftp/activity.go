@@ -0,0 +1,143 @@
+package sftp
+
+import (
+	"github.com/apex/log"
+	"github.com/pterodactyl/wings/api"
+	"github.com/pterodactyl/wings/server"
+	"sync"
+	"time"
+)
+
+const (
+	ActivityCreate  = "create"
+	ActivityWrite   = "write"
+	ActivityDelete  = "delete"
+	ActivityRename  = "rename"
+	ActivityMkdir   = "mkdir"
+	ActivityRmdir   = "rmdir"
+	ActivitySymlink = "symlink"
+	ActivitySetstat = "setstat"
+)
+
+const (
+	// The number of entries that causes the activity to be sent to the Panel right away,
+	// rather than waiting for the next interval.
+	activityBatchSize = 100
+	// The maximum number of entries that are kept while the Panel cannot be reached. Once
+	// this is reached the oldest entries are dropped.
+	activityMaxQueued = 5000
+	activityInterval  = 10 * time.Second
+)
+
+type activityQueue struct {
+	mu      sync.Mutex
+	entries []api.SftpActivity
+	flush   chan struct{}
+
+	// Sends a batch of entries to the Panel.
+	sender func(entries []api.SftpActivity) error
+}
+
+var activity = newActivityQueue()
+
+func newActivityQueue() *activityQueue {
+	return &activityQueue{
+		flush: make(chan struct{}, 1),
+		sender: func(entries []api.SftpActivity) error {
+			return api.New().SendSftpActivity(entries)
+		},
+	}
+}
+
+// Records an action that modified the files for the server. The entry is published to any
+// websockets listening to the server right away, and sent to the Panel with the next batch.
+func (fs FileSystem) record(action string, p string, target string) {
+	a := api.SftpActivity{
+		Server:    fs.UUID,
+		User:      fs.Username,
+		IP:        fs.IP,
+		Action:    action,
+		Path:      p,
+		Target:    target,
+		Timestamp: time.Now().UTC(),
+	}
+
+	activity.push(a)
+
+	s := server.GetServers().Find(func(s *server.Server) bool {
+		return s.Id() == fs.UUID
+	})
+
+	if s != nil {
+		_ = s.Events().PublishJson(server.SftpActivityEvent, a)
+	}
+}
+
+// Adds an entry to the queue, triggering a flush if there are enough entries to send a batch.
+func (q *activityQueue) push(a api.SftpActivity) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.entries = append(q.entries, a)
+	if len(q.entries) > activityMaxQueued {
+		q.entries = q.entries[len(q.entries)-activityMaxQueued:]
+	}
+
+	if len(q.entries) >= activityBatchSize {
+		select {
+		case q.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sends all of the queued entries to the Panel. If they cannot be sent they are returned to the
+// queue and sent along with the next batch.
+func (q *activityQueue) send() {
+	q.mu.Lock()
+	entries := q.entries
+	q.entries = nil
+	q.mu.Unlock()
+
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > activityBatchSize {
+			n = activityBatchSize
+		}
+
+		if err := q.sender(entries[:n]); err != nil {
+			log.WithFields(log.Fields{
+				"subsystem": "sftp",
+				"entries":   len(entries),
+				"error":     err,
+			}).Warn("failed to send sftp activity to the panel")
+
+			q.mu.Lock()
+			q.entries = append(entries, q.entries...)
+			if len(q.entries) > activityMaxQueued {
+				q.entries = q.entries[len(q.entries)-activityMaxQueued:]
+			}
+			q.mu.Unlock()
+
+			return
+		}
+
+		entries = entries[n:]
+	}
+}
+
+// Sends the queued activity to the Panel at a regular interval, or sooner if a full batch is
+// waiting to be sent. This blocks forever and should be run in its own go-routine.
+func (q *activityQueue) process() {
+	ticker := time.NewTicker(activityInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.flush:
+		}
+
+		q.send()
+	}
+}
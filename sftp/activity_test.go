@@ -0,0 +1,136 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/franela/goblin"
+	"github.com/pterodactyl/wings/api"
+	"testing"
+)
+
+func activityEntries(start int, n int) []api.SftpActivity {
+	var out []api.SftpActivity
+	for i := start; i < start+n; i++ {
+		out = append(out, api.SftpActivity{Action: ActivityWrite, Path: fmt.Sprintf("/file-%d", i)})
+	}
+
+	return out
+}
+
+func activityPaths(entries []api.SftpActivity) []string {
+	var out []string
+	for _, a := range entries {
+		out = append(out, a.Path)
+	}
+
+	return out
+}
+
+func TestActivityQueue(t *testing.T) {
+	g := Goblin(t)
+
+	var q *activityQueue
+	var sent [][]api.SftpActivity
+
+	g.Describe("ActivityQueue", func() {
+		g.BeforeEach(func() {
+			sent = nil
+			q = newActivityQueue()
+			q.sender = func(entries []api.SftpActivity) error {
+				sent = append(sent, append([]api.SftpActivity{}, entries...))
+				return nil
+			}
+		})
+
+		g.Describe("push", func() {
+			g.It("only triggers a flush once a full batch is queued", func() {
+				for _, a := range activityEntries(0, activityBatchSize-1) {
+					q.push(a)
+				}
+				g.Assert(len(q.flush)).Equal(0)
+
+				q.push(activityEntries(activityBatchSize, 1)[0])
+				g.Assert(len(q.flush)).Equal(1)
+			})
+
+			g.It("drops the oldest entries once the maximum is reached", func() {
+				for _, a := range activityEntries(0, activityMaxQueued+5) {
+					q.push(a)
+				}
+
+				g.Assert(len(q.entries)).Equal(activityMaxQueued)
+				g.Assert(q.entries[0].Path).Equal("/file-5")
+				g.Assert(q.entries[activityMaxQueued-1].Path).Equal(fmt.Sprintf("/file-%d", activityMaxQueued+4))
+			})
+		})
+
+		g.Describe("send", func() {
+			cases := []struct {
+				name    string
+				queued  int
+				batches []int
+			}{
+				{name: "sends nothing when the queue is empty", queued: 0},
+				{name: "sends a partial batch", queued: 3, batches: []int{3}},
+				{name: "sends a full batch", queued: activityBatchSize, batches: []int{activityBatchSize}},
+				{name: "splits the entries into batches", queued: activityBatchSize*2 + 1, batches: []int{activityBatchSize, activityBatchSize, 1}},
+			}
+
+			for _, c := range cases {
+				c := c
+
+				g.It(c.name, func() {
+					q.entries = activityEntries(0, c.queued)
+					q.send()
+
+					var sizes []int
+					var paths []string
+					for _, b := range sent {
+						sizes = append(sizes, len(b))
+						paths = append(paths, activityPaths(b)...)
+					}
+
+					g.Assert(sizes).Equal(c.batches)
+					g.Assert(paths).Equal(activityPaths(activityEntries(0, c.queued)))
+					g.Assert(len(q.entries)).Equal(0)
+				})
+			}
+
+			g.It("requeues the entries that could not be sent ahead of newer entries", func() {
+				q.entries = activityEntries(0, activityBatchSize+2)
+				q.sender = func(entries []api.SftpActivity) error {
+					if len(sent) > 0 {
+						q.push(activityEntries(1000, 1)[0])
+						return errors.New("panel is unavailable")
+					}
+
+					sent = append(sent, entries)
+					return nil
+				}
+
+				q.send()
+
+				g.Assert(len(sent)).Equal(1)
+				g.Assert(activityPaths(q.entries)).Equal([]string{
+					fmt.Sprintf("/file-%d", activityBatchSize),
+					fmt.Sprintf("/file-%d", activityBatchSize+1),
+					"/file-1000",
+				})
+			})
+
+			g.It("drops the oldest entries when requeueing more than the maximum", func() {
+				q.entries = activityEntries(0, activityMaxQueued)
+				q.sender = func(entries []api.SftpActivity) error {
+					q.push(activityEntries(activityMaxQueued, 1)[0])
+					return errors.New("panel is unavailable")
+				}
+
+				q.send()
+
+				g.Assert(len(q.entries)).Equal(activityMaxQueued)
+				g.Assert(q.entries[0].Path).Equal("/file-1")
+				g.Assert(q.entries[activityMaxQueued-1].Path).Equal(fmt.Sprintf("/file-%d", activityMaxQueued))
+			})
+		})
+	})
+}
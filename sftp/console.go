@@ -0,0 +1,221 @@
+package sftp
+
+import (
+	"bufio"
+	"github.com/apex/log"
+	"github.com/pterodactyl/wings/environment"
+	"github.com/pterodactyl/wings/events"
+	"github.com/pterodactyl/wings/server"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"strings"
+	"time"
+)
+
+// The number of lines of console output that are buffered for a session. If the client is not
+// reading output quickly enough the oldest lines are dropped, rather than blocking the event bus
+// for the server.
+const consoleBufferSize = 512
+
+// How often a console session checks that the server has not been suspended.
+const consoleSuspensionInterval = 5 * time.Second
+
+// The same permission that is required to send commands to a server over the websocket.
+const PermissionControlConsole = "control.console"
+
+// The payload sent with a "pty-req" request.
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// The payload sent with a "window-change" request.
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// A session attached to the console of a server. When the client requested a pty the input is
+// handled by a terminal so that typed characters are echoed back and lines can be edited,
+// otherwise input is read as plain lines.
+type consoleSession struct {
+	server  *server.Server
+	channel ssh.Channel
+	term    *terminal.Terminal
+	logger  *log.Entry
+	output  chan string
+}
+
+// Creates a new console session for a server on the channel.
+func newConsoleSession(s *server.Server, channel ssh.Channel, pty *ptyRequest, logger *log.Entry) *consoleSession {
+	cs := &consoleSession{
+		server:  s,
+		channel: channel,
+		logger:  logger,
+		output:  make(chan string, consoleBufferSize),
+	}
+
+	if pty != nil {
+		cs.term = terminal.NewTerminal(channel, "")
+		cs.resize(pty.Columns, pty.Rows)
+	}
+
+	return cs
+}
+
+// Updates the size of the terminal when the client window is resized.
+func (cs *consoleSession) resize(columns uint32, rows uint32) {
+	if cs.term == nil || columns == 0 || rows == 0 {
+		return
+	}
+
+	_ = cs.term.SetSize(int(columns), int(rows))
+}
+
+// Writes a line of output to the client.
+func (cs *consoleSession) writeLine(line string) {
+	if cs.term != nil {
+		// The terminal converts newlines into the carriage return and newline the client
+		// expects, and redraws anything the user was in the middle of typing.
+		_, _ = cs.term.Write([]byte(line + "\n"))
+		return
+	}
+
+	_, _ = cs.channel.Write([]byte(line + "\n"))
+}
+
+// Queues a line of output to be written to the client. This is called by the event bus for the
+// server, so it must never block. If the buffer is full the oldest line is dropped to make room.
+func (cs *consoleSession) queue(line string) {
+	for {
+		select {
+		case cs.output <- line:
+			return
+		default:
+		}
+
+		select {
+		case <-cs.output:
+		default:
+		}
+	}
+}
+
+// Writes the queued output to the client until the session is closed. The connection is closed
+// if the server is suspended while the session is open.
+func (cs *consoleSession) writeOutput(done <-chan struct{}) {
+	ticker := time.NewTicker(consoleSuspensionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case line := <-cs.output:
+			cs.writeLine(line)
+		case <-ticker.C:
+			if cs.server.IsSuspended() {
+				cs.writeLine("This server has been suspended, closing the console.")
+				_ = cs.channel.Close()
+				return
+			}
+		}
+	}
+}
+
+// Streams the console output of the server to the client, and sends each line typed by the
+// client to the server as a command. This blocks until the client closes the session.
+func (cs *consoleSession) run() {
+	defer cs.channel.Close()
+
+	listener := func(e events.Event) {
+		cs.queue(e.Data)
+	}
+
+	cs.server.Events().On(server.ConsoleOutputEvent, &listener)
+	defer cs.server.Events().Off(server.ConsoleOutputEvent, &listener)
+
+	// Send the recent output of the server so the user has some context for what is going on,
+	// the same as when the console is opened in the panel.
+	if running, _ := cs.server.Environment.IsRunning(); running {
+		if logs, err := cs.server.Environment.Readlog(100); err == nil {
+			for _, line := range logs {
+				cs.writeLine(line)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go cs.writeOutput(done)
+
+	var r *bufio.Reader
+	if cs.term == nil {
+		r = bufio.NewReader(cs.channel)
+	}
+
+	for {
+		var line string
+		var err error
+		if cs.term != nil {
+			line, err = cs.term.ReadLine()
+		} else {
+			line, err = r.ReadString('\n')
+			line = strings.TrimRight(line, "\r\n")
+		}
+
+		if line != "" {
+			cs.sendCommand(line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	_, _ = cs.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+}
+
+// Sends a command to the server if it is running.
+func (cs *consoleSession) sendCommand(line string) {
+	if cs.server.GetState() == environment.ProcessOfflineState {
+		cs.writeLine("The server is not running, the command was not sent.")
+		return
+	}
+
+	if err := cs.server.Environment.SendCommand(line); err != nil {
+		cs.logger.WithField("error", err).Warn("failed to send command to server from ssh console")
+	}
+}
+
+// Creates a console session for the server the user logged in to. Returns false if
+// the user does not have permission to use the console, or the server cannot be found.
+func (c Server) openConsole(sc *ssh.ServerConn, channel ssh.Channel, pty *ptyRequest) (*consoleSession, bool) {
+	if !HasPermission(strings.Split(sc.Permissions.Extensions["permissions"], ","), PermissionControlConsole) {
+		return nil, false
+	}
+
+	s := server.GetServers().Find(func(s *server.Server) bool {
+		return s.Id() == sc.Permissions.Extensions["uuid"]
+	})
+
+	if s == nil || s.IsSuspended() {
+		return nil, false
+	}
+
+	cs := newConsoleSession(s, channel, pty, log.WithFields(log.Fields{
+		"subsystem": "sftp",
+		"server":    s.Id(),
+		"username":  sc.User(),
+		"ip":        sc.RemoteAddr(),
+	}))
+
+	return cs, true
+}
@@ -1,5 +1,16 @@
 package sftp
 
+import (
+	"github.com/pkg/errors"
+)
+
+// Returned when a login is attempted from an IP address or for a username that has been
+// blocked after too many failed attempts.
+var ErrLoginBlocked = errors.New("too many failed login attempts, try again later")
+
+// Returned when a user attempts to access a path outside of the paths they are limited to.
+var ErrPathNotAllowed = errors.New("the requested path is outside of the allowed paths")
+
 type fxerr uint32
 
 const (
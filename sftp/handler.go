@@ -8,8 +8,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 type FileSystem struct {
@@ -19,15 +23,86 @@ type FileSystem struct {
 	User        User
 	Cache       *cache.Cache
 
+	// The username and IP address of the user that is logged in, used when recording the
+	// activity for the session.
+	Username string
+	IP       string
+
+	// The directory containing the server's files, and the paths within it that the user is
+	// allowed to access. If no paths are set the user can access every file for the server.
+	Root  string
+	Paths []string
+
 	PathValidator func(fs FileSystem, p string) (string, error)
 	HasDiskSpace  func(fs FileSystem) bool
+	DiskUsage     func(fs FileSystem) (int64, int64, error)
 
-	logger *log.Entry
-	lock   sync.Mutex
+	session *Session
+	logger  *log.Entry
+	lock    sync.Mutex
 }
 
+// Returns the full path to a file the user is allowed to access. If the user is limited to a
+// set of paths, both the requested path and the location it resolves to must be within them.
 func (fs FileSystem) buildPath(p string) (string, error) {
-	return fs.PathValidator(fs, p)
+	return fs.resolvePath(p, false)
+}
+
+// Returns the full path to a file or directory that can be listed by the user. This is the same
+// as buildPath, except the parent directories of the paths the user is limited to are allowed
+// so that they can be navigated to.
+func (fs FileSystem) buildListPath(p string) (string, error) {
+	return fs.resolvePath(p, true)
+}
+
+func (fs FileSystem) resolvePath(p string, parents bool) (string, error) {
+	if !fs.inScope(p, parents) {
+		return "", ErrPathNotAllowed
+	}
+
+	r, err := fs.PathValidator(fs, p)
+	if err != nil {
+		return "", err
+	}
+
+	// A symlink within one of the allowed paths could point somewhere outside of them, so
+	// the resolved location needs to be checked as well.
+	if len(fs.Paths) > 0 {
+		rel, err := filepath.Rel(fs.Root, r)
+		if err != nil || !fs.inScope("/"+rel, parents) {
+			return "", ErrPathNotAllowed
+		}
+	}
+
+	return r, nil
+}
+
+// Determines if a path, relative to the root of the server, is within one of the paths the user
+// is allowed to access.
+func (fs FileSystem) inScope(p string, parents bool) bool {
+	return InScope(fs.Paths, p, parents)
+}
+
+// Determines if a path, relative to the root of a server, is within one of the given paths. If
+// parents is true the directories leading up to the paths are included as well, so that they can
+// be navigated to. If no paths are given every path is allowed.
+func InScope(paths []string, p string, parents bool) bool {
+	if len(paths) == 0 {
+		return true
+	}
+
+	p = path.Clean("/" + p)
+	for _, a := range paths {
+		if p == a || strings.HasPrefix(p, a+"/") {
+			return true
+		}
+
+		if parents && (p == "/" || strings.HasPrefix(a, p+"/")) {
+			return true
+		}
+	}
+
+	return false
 }
 
 const (
@@ -36,6 +111,9 @@ const (
 	PermissionFileCreate      = "file.create"
 	PermissionFileUpdate      = "file.update"
 	PermissionFileDelete      = "file.delete"
+	PermissionFileChmod       = "file.chmod"
+	PermissionFileTouch       = "file.touch"
+	PermissionFileSymlink     = "file.symlink"
 )
 
 // Fileread creates a reader for a file on the system and returns the reader back.
@@ -69,7 +147,7 @@ func (fs FileSystem) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		return nil, sftp.ErrSshFxFailure
 	}
 
-	return file, nil
+	return fs.track(file), nil
 }
 
 // Filewrite handles the write actions for a file on the system.
@@ -127,7 +205,9 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 			l.WithField("error", errors.WithStack(err)).Warn("failed to set permissions on file")
 		}
 
-		return file, nil
+		fs.record(ActivityCreate, request.Filepath, "")
+
+		return fs.track(file), nil
 	}
 
 	// If the stat error isn't about the file not existing, there is some other issue
@@ -169,7 +249,9 @@ func (fs FileSystem) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		l.WithField("error", errors.WithStack(err)).Warn("error chowning file")
 	}
 
-	return file, nil
+	fs.record(ActivityWrite, request.Filepath, "")
+
+	return fs.track(file), nil
 }
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
@@ -199,30 +281,15 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 
 	switch request.Method {
 	case "Setstat":
-		if !fs.can(PermissionFileUpdate) {
-			return sftp.ErrSshFxPermissionDenied
-		}
-
-		var mode os.FileMode = 0644
-		// If the client passed a valid file permission use that, otherwise use the
-		// default of 0644 set above.
-		if request.Attributes().FileMode().Perm() != 0000 {
-			mode = request.Attributes().FileMode().Perm()
+		applied, err := fs.setstat(request, p, l)
+		if err != nil {
+			return err
 		}
 
-		// Force directories to be 0755
-		if request.Attributes().FileMode().IsDir() {
-			mode = 0755
+		if applied {
+			fs.record(ActivitySetstat, request.Filepath, "")
 		}
 
-		if err := os.Chmod(p, mode); err != nil {
-			if os.IsNotExist(err) {
-				return sftp.ErrSSHFxNoSuchFile
-			}
-
-			l.WithField("error", errors.WithStack(err)).Error("failed to perform setstat on item")
-			return sftp.ErrSSHFxFailure
-		}
 		return nil
 	case "Rename":
 		if !fs.can(PermissionFileUpdate) {
@@ -239,6 +306,8 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.record(ActivityRename, request.Filepath, request.Target)
+
 		break
 	case "Rmdir":
 		if !fs.can(PermissionFileDelete) {
@@ -251,6 +320,8 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.record(ActivityRmdir, request.Filepath, "")
+
 		return sftp.ErrSshFxOk
 	case "Mkdir":
 		if !fs.can(PermissionFileCreate) {
@@ -263,19 +334,37 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.record(ActivityMkdir, request.Filepath, "")
+
 		break
 	case "Symlink":
-		if !fs.can(PermissionFileCreate) {
+		// The path of the request is the file being linked to, and the target is the location
+		// of the new link. Both have already been resolved within the server's data directory.
+		if !fs.can(PermissionFileSymlink) || target == "" {
 			return sftp.ErrSshFxPermissionDenied
 		}
 
-		if err := os.Symlink(p, target); err != nil {
+		// Store the link relative to its own location so that it never contains the path of
+		// the data directory on the host, and keeps working if the server is moved.
+		rel, err := filepath.Rel(filepath.Dir(target), p)
+		if err != nil {
+			return sftp.ErrSshFxOpUnsupported
+		}
+
+		if err := os.Symlink(rel, target); err != nil {
 			l.WithField("target", target).WithField("error", errors.WithStack(err)).Error("failed to create symlink")
 
 			return sftp.ErrSshFxFailure
 		}
 
-		break
+		// Change the owner of the link itself, rather than the file it points to.
+		if err := os.Lchown(target, fs.User.Uid, fs.User.Gid); err != nil {
+			l.WithField("error", errors.WithStack(err)).Warn("error chowning symlink")
+		}
+
+		fs.record(ActivitySymlink, request.Filepath, request.Target)
+
+		return sftp.ErrSshFxOk
 	case "Remove":
 		if !fs.can(PermissionFileDelete) {
 			return sftp.ErrSshFxPermissionDenied
@@ -291,6 +380,8 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 			return sftp.ErrSshFxFailure
 		}
 
+		fs.record(ActivityDelete, request.Filepath, "")
+
 		return sftp.ErrSshFxOk
 	default:
 		return sftp.ErrSshFxOpUnsupported
@@ -311,10 +402,69 @@ func (fs FileSystem) Filecmd(request *sftp.Request) error {
 	return sftp.ErrSshFxOk
 }
 
+// Applies the attributes sent with a setstat request to a file. Changing the mode and the
+// modification time of a file each require their own permission. Changes to the owner or
+// size of a file are ignored, since the owner is always the user wings runs the server as.
+// Returns false if none of the attributes were changed.
+func (fs FileSystem) setstat(request *sftp.Request, p string, l *log.Entry) (bool, error) {
+	flags := request.AttrFlags()
+	attrs := request.Attributes()
+
+	// Most clients set the mode and modification time of a file right after uploading it, so
+	// any attributes the user is not allowed to change are skipped rather than failing the
+	// request, which would cause the entire upload to be reported as failed.
+	chmod := flags.Permissions && fs.can(PermissionFileChmod)
+	touch := flags.Acmodtime && fs.can(PermissionFileTouch)
+	if flags.Permissions && !chmod || flags.Acmodtime && !touch {
+		l.Debug("skipping attributes the user does not have permission to change")
+	}
+
+	if !chmod && !touch {
+		return false, nil
+	}
+
+	st, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, sftp.ErrSSHFxNoSuchFile
+		}
+
+		l.WithField("error", errors.WithStack(err)).Error("failed to perform stat on item for setstat")
+		return false, sftp.ErrSSHFxFailure
+	}
+
+	if chmod {
+		// Only the permission bits can be changed, the setuid, setgid and sticky bits are
+		// always dropped. The owner must also always be able to read and write the file, and
+		// enter a directory, otherwise the panel could no longer manage it.
+		mode := os.FileMode(attrs.Mode).Perm() | 0600
+		if st.IsDir() {
+			mode |= 0100
+		}
+
+		if err := os.Chmod(p, mode); err != nil {
+			l.WithField("mode", mode).WithField("error", errors.WithStack(err)).Error("failed to perform chmod on item")
+			return false, sftp.ErrSSHFxFailure
+		}
+	}
+
+	if touch {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+
+		if err := os.Chtimes(p, atime, mtime); err != nil {
+			l.WithField("error", errors.WithStack(err)).Error("failed to update the times of item")
+			return false, sftp.ErrSSHFxFailure
+		}
+	}
+
+	return true, nil
+}
+
 // Filelist is the handler for SFTP filesystem list calls. This will handle calls to list the contents of
 // a directory as well as perform file/folder stat calls.
 func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
-	p, err := fs.buildPath(request.Filepath)
+	p, err := fs.buildListPath(request.Filepath)
 	if err != nil {
 		return nil, sftp.ErrSshFxNoSuchFile
 	}
@@ -332,6 +482,25 @@ func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 			return nil, sftp.ErrSshFxFailure
 		}
 
+		// Hide anything that is outside of the paths the user is allowed to access, leaving
+		// only the directories that lead to them. The directory that was actually read is used
+		// rather than the requested path, since the two differ if a symlink was followed.
+		if len(fs.Paths) > 0 {
+			rel, err := filepath.Rel(fs.Root, p)
+			if err != nil {
+				return nil, sftp.ErrSshFxNoSuchFile
+			}
+
+			visible := make([]os.FileInfo, 0, len(files))
+			for _, f := range files {
+				if fs.inScope(path.Join("/"+rel, f.Name()), true) {
+					visible = append(visible, f)
+				}
+			}
+
+			files = visible
+		}
+
 		return ListerAt(files), nil
 	case "Stat":
 		if !fs.can(PermissionFileRead) {
@@ -358,19 +527,93 @@ func (fs FileSystem) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	}
 }
 
+// StatVFS handles the statvfs@openssh.com extension. The disk space reported is the space the
+// server is limited to, rather than the size of the disk on the host system, so that clients
+// show the real amount of space the user has left. Servers without a limit report the disk of
+// the host system.
+func (fs FileSystem) StatVFS(request *sftp.Request) (*sftp.StatVFS, error) {
+	if !fs.can(PermissionFileRead) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
+	if _, err := fs.buildListPath(request.Filepath); err != nil {
+		return nil, sftp.ErrSshFxNoSuchFile
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fs.Root, &st); err != nil {
+		fs.logger.WithField("error", errors.WithStack(err)).Error("failed to perform statfs on server directory")
+
+		return nil, sftp.ErrSshFxFailure
+	}
+
+	bsize := uint64(st.Bsize)
+	stat := &sftp.StatVFS{
+		Bsize:   bsize,
+		Frsize:  bsize,
+		Blocks:  st.Blocks,
+		Bfree:   st.Bavail,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Favail:  st.Ffree,
+		Namemax: 255,
+	}
+
+	used, limit, err := fs.DiskUsage(fs)
+	if err != nil {
+		return nil, sftp.ErrSshFxFailure
+	}
+
+	if limit > 0 && bsize > 0 {
+		stat.Blocks, stat.Bavail = quotaBlocks(used, limit, bsize, st.Bavail)
+		stat.Bfree = stat.Bavail
+	}
+
+	if fs.ReadOnly {
+		// ST_RDONLY
+		stat.Flag |= 0x1
+	}
+
+	return stat, nil
+}
+
+// Returns the total and free number of blocks to report for a server that is limited to using
+// the given number of bytes. The free blocks are capped to the blocks available on the disk.
+func quotaBlocks(used int64, limit int64, bsize uint64, available uint64) (uint64, uint64) {
+	free := uint64(0)
+	if used < limit {
+		free = uint64(limit-used) / bsize
+	}
+
+	// The server can never use more space than is actually available on the disk, even if it
+	// is well below its limit.
+	if free > available {
+		free = available
+	}
+
+	return uint64(limit) / bsize, free
+}
+
 // Determines if a user has permission to perform a specific action on the SFTP server. These
 // permissions are defined and returned by the Panel API.
 func (fs FileSystem) can(permission string) bool {
+	return HasPermission(fs.Permissions, permission)
+}
+
+// Determines if the given permission is within the set of permissions returned by the Panel
+// for a user.
+func HasPermission(permissions []string, permission string) bool {
 	// Server owners and super admins have their permissions returned as '[*]' via the Panel
 	// API, so for the sake of speed do an initial check for that before iterating over the
 	// entire array of permissions.
-	if len(fs.Permissions) == 1 && fs.Permissions[0] == "*" {
+	if len(permissions) == 1 && permissions[0] == "*" {
 		return true
 	}
 
 	// Not the owner or an admin, loop over the permissions that were returned to determine
 	// if they have the passed permission.
-	for _, p := range fs.Permissions {
+	for _, p := range permissions {
 		if p == permission {
 			return true
 		}
@@ -0,0 +1,194 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/apex/log"
+	. "github.com/franela/goblin"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPathScope(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("inScope", func() {
+		fs := FileSystem{Paths: []string{"/plugins", "/world/region"}}
+
+		cases := []struct {
+			path    string
+			parents bool
+			allowed bool
+		}{
+			{path: "/plugins", allowed: true},
+			{path: "/plugins/config.yml", allowed: true},
+			{path: "plugins/a/b", allowed: true},
+			{path: "/plugins2", allowed: false},
+			{path: "/plugins/../server.properties", allowed: false},
+			{path: "/server.properties", allowed: false},
+			{path: "/", allowed: false},
+			{path: "/", parents: true, allowed: true},
+			{path: "/world", allowed: false},
+			{path: "/world", parents: true, allowed: true},
+			{path: "/world/level.dat", parents: true, allowed: false},
+			{path: "/world/region/r.0.0.mca", parents: true, allowed: true},
+			{path: "/wor", parents: true, allowed: false},
+		}
+
+		for _, c := range cases {
+			c := c
+
+			g.It(fmt.Sprintf("returns %t for %s (parents: %t)", c.allowed, c.path, c.parents), func() {
+				g.Assert(fs.inScope(c.path, c.parents)).Equal(c.allowed)
+			})
+		}
+
+		g.It("allows every path when the user is not limited", func() {
+			g.Assert(FileSystem{}.inScope("/server.properties", false)).IsTrue()
+		})
+	})
+
+	g.Describe("allowedPaths", func() {
+		g.It("returns an error if the paths cannot be decoded", func() {
+			_, err := allowedPaths("")
+			g.Assert(err).IsNotNil()
+
+			_, err = allowedPaths(`{"paths":["/plugins"]}`)
+			g.Assert(err).IsNotNil()
+		})
+
+		g.It("returns no paths when the user is not limited", func() {
+			paths, err := allowedPaths("null")
+			g.Assert(err).IsNil()
+			g.Assert(len(paths)).Equal(0)
+
+			paths, err = allowedPaths(`["/plugins", "/"]`)
+			g.Assert(err).IsNil()
+			g.Assert(len(paths)).Equal(0)
+
+			paths, err = allowedPaths(`["world/.."]`)
+			g.Assert(err).IsNil()
+			g.Assert(len(paths)).Equal(0)
+		})
+
+		g.It("cleans the paths", func() {
+			paths, err := allowedPaths(`["plugins/", "/a/../world//region", "../../etc"]`)
+			g.Assert(err).IsNil()
+			g.Assert(paths).Equal([]string{"/plugins", "/world/region", "/etc"})
+		})
+	})
+}
+
+func TestQuotaBlocks(t *testing.T) {
+	g := Goblin(t)
+
+	cases := []struct {
+		name      string
+		used      int64
+		limit     int64
+		available uint64
+		blocks    uint64
+		free      uint64
+	}{
+		{name: "reports the space left below the limit", used: 4096 * 10, limit: 4096 * 100, available: 1000, blocks: 100, free: 90},
+		{name: "reports no space when the limit is reached", used: 4096 * 100, limit: 4096 * 100, available: 1000, blocks: 100, free: 0},
+		{name: "reports no space when over the limit", used: 4096 * 150, limit: 4096 * 100, available: 1000, blocks: 100, free: 0},
+		{name: "never reports more space than the disk has available", used: 0, limit: 4096 * 100, available: 20, blocks: 100, free: 20},
+		{name: "rounds partial blocks down", used: 4096*10 + 1, limit: 4096*100 + 4095, available: 1000, blocks: 100, free: 90},
+		{name: "reports an empty server", used: 0, limit: 4096 * 100, available: 1000, blocks: 100, free: 100},
+	}
+
+	g.Describe("quotaBlocks", func() {
+		for _, c := range cases {
+			c := c
+
+			g.It(c.name, func() {
+				blocks, free := quotaBlocks(c.used, c.limit, 4096, c.available)
+
+				g.Assert(blocks).Equal(c.blocks)
+				g.Assert(free).Equal(c.free)
+			})
+		}
+	})
+}
+
+// Builds a setstat request that changes both the mode and the times of a file.
+func setstatRequest(mode uint32, mtime time.Time) *sftp.Request {
+	attrs := make([]byte, 12)
+	binary.BigEndian.PutUint32(attrs[0:], mode)
+	binary.BigEndian.PutUint32(attrs[4:], uint32(mtime.Unix()))
+	binary.BigEndian.PutUint32(attrs[8:], uint32(mtime.Unix()))
+
+	r := sftp.NewRequest("Setstat", "/file.txt")
+	// SSH_FILEXFER_ATTR_PERMISSIONS | SSH_FILEXFER_ATTR_ACMODTIME
+	r.Flags = 0x4 | 0x8
+	r.Attrs = attrs
+
+	return r
+}
+
+func TestSetstat(t *testing.T) {
+	g := Goblin(t)
+
+	var dir string
+	var p string
+	mtime := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	setstat := func(permissions ...string) (bool, error) {
+		fs := FileSystem{Permissions: permissions}
+
+		return fs.setstat(setstatRequest(0755, mtime), p, log.WithField("subsystem", "sftp"))
+	}
+
+	g.Describe("setstat", func() {
+		g.BeforeEach(func() {
+			var err error
+			if dir, err = ioutil.TempDir(os.TempDir(), "pterodactyl"); err != nil {
+				panic(err)
+			}
+
+			p = filepath.Join(dir, "file.txt")
+			if err := ioutil.WriteFile(p, []byte("test"), 0644); err != nil {
+				panic(err)
+			}
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("applies every attribute the user is allowed to change", func() {
+			applied, err := setstat(PermissionFileChmod, PermissionFileTouch)
+			g.Assert(err).IsNil()
+			g.Assert(applied).IsTrue()
+
+			st, _ := os.Stat(p)
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0755))
+			g.Assert(st.ModTime().Equal(mtime)).IsTrue()
+		})
+
+		g.It("skips the attributes the user is not allowed to change", func() {
+			applied, err := setstat(PermissionFileTouch)
+			g.Assert(err).IsNil()
+			g.Assert(applied).IsTrue()
+
+			st, _ := os.Stat(p)
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0644))
+			g.Assert(st.ModTime().Equal(mtime)).IsTrue()
+		})
+
+		g.It("does nothing if the user cannot change any of the attributes", func() {
+			applied, err := setstat(PermissionFileRead)
+			g.Assert(err).IsNil()
+			g.Assert(applied).IsFalse()
+
+			st, _ := os.Stat(p)
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0644))
+			g.Assert(st.ModTime().Equal(mtime)).IsFalse()
+		})
+	})
+}
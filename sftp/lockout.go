@@ -0,0 +1,285 @@
+package sftp
+
+import (
+	"github.com/apex/log"
+	"github.com/pterodactyl/wings/api"
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/server"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BanTypeIp       = "ip"
+	BanTypeUsername = "username"
+)
+
+// Details about an IP address or username that has failed to login to the SFTP server.
+type Ban struct {
+	Type     string    `json:"type"`
+	Value    string    `json:"value"`
+	Attempts int       `json:"attempts"`
+	Lockouts int       `json:"lockouts"`
+	Until    time.Time `json:"until"`
+}
+
+type loginFailures struct {
+	attempts int
+	lockouts int
+	last     time.Time
+	until    time.Time
+}
+
+type lockout struct {
+	mu     sync.Mutex
+	failed map[string]map[string]*loginFailures
+	pruned time.Time
+
+	// Returns the current time, this is only replaced when testing.
+	now func() time.Time
+}
+
+var bans = newLockout()
+
+func newLockout() *lockout {
+	return &lockout{
+		failed: map[string]map[string]*loginFailures{
+			BanTypeIp:       make(map[string]*loginFailures),
+			BanTypeUsername: make(map[string]*loginFailures),
+		},
+		now: time.Now,
+	}
+}
+
+// Returns the IP address for a remote address, without the port.
+func remoteIp(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// Returns the time until which logins from the IP address or for the username are blocked,
+// and true if either of them is currently blocked.
+func (l *lockout) blocked(ip string, username string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	var until time.Time
+	for t, v := range map[string]string{BanTypeIp: ip, BanTypeUsername: strings.ToLower(username)} {
+		if f, ok := l.failed[t][v]; ok && f.until.After(now) && f.until.After(until) {
+			until = f.until
+		}
+	}
+
+	return until, !until.IsZero()
+}
+
+// Records a failed login from the IP address for the username. Once either of them reaches the
+// maximum number of attempts further logins are blocked, with each lockout lasting twice as
+// long as the previous one. If the IP address was blocked by this attempt the time the block
+// expires is returned.
+func (l *lockout) fail(ip string, username string) time.Time {
+	cfg := config.Get().System.Sftp.Lockout
+	if cfg.MaxAttempts <= 0 {
+		return time.Time{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	maxDuration := time.Duration(cfg.MaxBanDuration) * time.Second
+	if cfg.MaxBanDuration < cfg.BanDuration {
+		maxDuration = time.Duration(cfg.BanDuration) * time.Second
+	}
+
+	// Every so often forget about any failures that are old enough to no longer matter, so
+	// that a large number of different IP addresses does not slowly use up memory.
+	if now.Sub(l.pruned) > time.Minute {
+		l.prune(now, maxDuration)
+		l.pruned = now
+	}
+
+	var blocked time.Time
+	for t, v := range map[string]string{BanTypeIp: ip, BanTypeUsername: strings.ToLower(username)} {
+		f, ok := l.failed[t][v]
+		if !ok || (now.Sub(f.last) > maxDuration && f.until.Before(now)) {
+			f = &loginFailures{}
+			l.failed[t][v] = f
+		}
+
+		f.attempts++
+		f.last = now
+
+		if f.attempts < cfg.MaxAttempts {
+			continue
+		}
+
+		d := time.Duration(cfg.BanDuration) * time.Second
+		for i := 0; i < f.lockouts && i < 16; i++ {
+			d *= 2
+		}
+
+		if d > maxDuration {
+			d = maxDuration
+		}
+
+		f.attempts = 0
+		f.lockouts++
+		f.until = now.Add(d)
+
+		log.WithFields(log.Fields{
+			"subsystem": "sftp",
+			"type":      t,
+			"value":     v,
+			"until":     f.until,
+		}).Warn("blocking sftp logins after too many failed attempts")
+
+		if t == BanTypeIp {
+			blocked = f.until
+		}
+	}
+
+	return blocked
+}
+
+// Clears the failed attempts for the IP address and username after a successful login. Any
+// previous lockouts are still counted if the IP address starts failing to login again.
+func (l *lockout) succeed(ip string, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for t, v := range map[string]string{BanTypeIp: ip, BanTypeUsername: strings.ToLower(username)} {
+		if f, ok := l.failed[t][v]; ok {
+			f.attempts = 0
+		}
+	}
+}
+
+// Removes any failures that have not been updated within the given duration and are no longer
+// blocking logins. The lock must be held when calling this function.
+func (l *lockout) prune(now time.Time, d time.Duration) {
+	for _, m := range l.failed {
+		for k, f := range m {
+			if now.Sub(f.last) > d && f.until.Before(now) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// Returns every IP address and username that is currently blocked from logging in to the SFTP
+// server, ordered by the time the block expires.
+func Bans() []Ban {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	now := bans.now()
+
+	out := make([]Ban, 0)
+	for t, m := range bans.failed {
+		for v, f := range m {
+			if f.until.After(now) {
+				out = append(out, Ban{Type: t, Value: v, Attempts: f.attempts, Lockouts: f.lockouts, Until: f.until})
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Until.Before(out[j].Until)
+	})
+
+	return out
+}
+
+// Clears any failed attempts and bans for the given IP address or username. Returns false if
+// there was nothing recorded for it.
+func ClearBan(t string, value string) bool {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	m, ok := bans.failed[t]
+	if !ok {
+		return false
+	}
+
+	if t == BanTypeUsername {
+		value = strings.ToLower(value)
+	}
+
+	if _, ok := m[value]; !ok {
+		return false
+	}
+
+	delete(m, value)
+
+	return true
+}
+
+// Clears every failed attempt and ban recorded by the SFTP server.
+func ClearBans() {
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+
+	for t := range bans.failed {
+		bans.failed[t] = make(map[string]*loginFailures)
+	}
+}
+
+// Notifies anyone listening to the server that the username was for that an IP address has
+// been blocked from logging in. Usernames end with the first eight characters of the UUID of
+// the server they are for, so that is used to find the server.
+func publishBlocked(ip string, username string, until time.Time) {
+	i := strings.LastIndex(username, ".")
+	if i < 0 || len(username)-i-1 != 8 {
+		return
+	}
+
+	id := strings.ToLower(username[i+1:])
+	s := server.GetServers().Find(func(s *server.Server) bool {
+		return strings.HasPrefix(s.Id(), id)
+	})
+
+	if s == nil {
+		return
+	}
+
+	_ = s.Events().PublishJson(server.SftpBlockedEvent, map[string]interface{}{
+		"ip":       ip,
+		"username": username,
+		"until":    until,
+	})
+}
+
+// Returns true if logins from the IP address or for the username are currently blocked. This
+// allows other services that accept the same credentials, such as the WebDAV server, to share
+// the lockout with the SFTP server.
+func LoginBlocked(ip string, username string) bool {
+	_, ok := bans.blocked(ip, username)
+
+	return ok
+}
+
+// Records the result of a login made using SFTP credentials outside of the SFTP server, so that
+// failed attempts count towards the same lockout. Only logins made using a password should be
+// recorded.
+func RecordLogin(ip string, username string, err error) {
+	if err == nil {
+		bans.succeed(ip, username)
+		return
+	}
+
+	if api.IsInvalidCredentialsError(err) {
+		if until := bans.fail(ip, username); !until.IsZero() {
+			publishBlocked(ip, username, until)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package sftp
+
+import (
+	. "github.com/franela/goblin"
+	"github.com/pterodactyl/wings/config"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	g := Goblin(t)
+
+	var l *lockout
+	var now time.Time
+
+	fail := func(n int, ip string, username string) time.Time {
+		var until time.Time
+		for i := 0; i < n; i++ {
+			until = l.fail(ip, username)
+		}
+
+		return until
+	}
+
+	g.Describe("Lockout", func() {
+		g.BeforeEach(func() {
+			config.Set(&config.Configuration{
+				AuthenticationToken: "abc",
+				System: config.SystemConfiguration{
+					Sftp: config.SftpConfiguration{
+						Lockout: config.SftpLockoutConfiguration{
+							MaxAttempts:    3,
+							BanDuration:    60,
+							MaxBanDuration: 180,
+						},
+					},
+				},
+			})
+
+			now = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+			l = newLockout()
+			l.now = func() time.Time {
+				return now
+			}
+		})
+
+		g.Describe("fail", func() {
+			g.It("blocks an ip address once the maximum attempts are reached", func() {
+				g.Assert(fail(2, "10.0.0.1", "user.abcdef12").IsZero()).IsTrue()
+
+				_, ok := l.blocked("10.0.0.1", "other")
+				g.Assert(ok).IsFalse()
+
+				until := l.fail("10.0.0.1", "user.abcdef12")
+				g.Assert(until).Equal(now.Add(time.Minute))
+
+				_, ok = l.blocked("10.0.0.1", "other")
+				g.Assert(ok).IsTrue()
+			})
+
+			g.It("blocks a username from every ip address", func() {
+				l.fail("10.0.0.1", "User.abcdef12")
+				l.fail("10.0.0.2", "user.abcdef12")
+				l.fail("10.0.0.3", "USER.ABCDEF12")
+
+				_, ok := l.blocked("10.0.0.4", "user.abcdef12")
+				g.Assert(ok).IsTrue()
+
+				_, ok = l.blocked("10.0.0.4", "other")
+				g.Assert(ok).IsFalse()
+			})
+
+			g.It("unblocks once the ban has expired", func() {
+				fail(3, "10.0.0.1", "user.abcdef12")
+
+				now = now.Add(time.Minute - time.Second)
+				_, ok := l.blocked("10.0.0.1", "other")
+				g.Assert(ok).IsTrue()
+
+				now = now.Add(time.Second)
+				_, ok = l.blocked("10.0.0.1", "other")
+				g.Assert(ok).IsFalse()
+			})
+
+			g.It("doubles the ban each time up to the maximum", func() {
+				for _, d := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+					until := fail(3, "10.0.0.1", "user.abcdef12")
+					g.Assert(until).Equal(now.Add(d))
+
+					now = until
+				}
+			})
+
+			g.It("forgets failures older than the maximum ban duration", func() {
+				fail(2, "10.0.0.1", "user.abcdef12")
+
+				now = now.Add(3*time.Minute + time.Second)
+				g.Assert(l.fail("10.0.0.1", "user.abcdef12").IsZero()).IsTrue()
+				g.Assert(l.failed[BanTypeIp]["10.0.0.1"].attempts).Equal(1)
+			})
+
+			g.It("does nothing when the lockout is disabled", func() {
+				config.Get().System.Sftp.Lockout.MaxAttempts = 0
+
+				g.Assert(fail(10, "10.0.0.1", "user.abcdef12").IsZero()).IsTrue()
+
+				_, ok := l.blocked("10.0.0.1", "user.abcdef12")
+				g.Assert(ok).IsFalse()
+			})
+		})
+
+		g.Describe("succeed", func() {
+			g.It("resets the attempts but remembers previous lockouts", func() {
+				fail(3, "10.0.0.1", "user.abcdef12")
+				now = now.Add(time.Minute)
+
+				fail(2, "10.0.0.1", "user.abcdef12")
+				l.succeed("10.0.0.1", "user.abcdef12")
+				g.Assert(fail(2, "10.0.0.1", "user.abcdef12").IsZero()).IsTrue()
+
+				until := l.fail("10.0.0.1", "user.abcdef12")
+				g.Assert(until).Equal(now.Add(2 * time.Minute))
+			})
+		})
+	})
+}
@@ -4,10 +4,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"github.com/pterodactyl/wings/api"
 	"golang.org/x/crypto/ssh"
@@ -41,9 +43,13 @@ type Server struct {
 	PathValidator      func(fs FileSystem, p string) (string, error)
 	DiskSpaceValidator func(fs FileSystem) bool
 
+	// Returns the amount of disk space used by the server the user is connected to, and the
+	// maximum amount of space it is allowed to use, in bytes.
+	DiskUsageResolver func(fs FileSystem) (int64, int64, error)
+
 	// Validator function that is called when a user connects to the server. This should
 	// check against whatever system is desired to confirm if the given username and password
-	// combination is valid. If so, should return an authentication response.
+	// or public key combination is valid. If so, should return an authentication response.
 	CredentialValidator func(r api.SftpAuthRequest) (*api.SftpAuthResponse, error)
 }
 
@@ -60,27 +66,18 @@ func (c *Server) Initialize() error {
 		NoClientAuth: false,
 		MaxAuthTries: 6,
 		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			resp, err := c.CredentialValidator(api.SftpAuthRequest{
-				User:          conn.User(),
-				Pass:          string(pass),
-				IP:            conn.RemoteAddr().String(),
-				SessionID:     conn.SessionID(),
-				ClientVersion: conn.ClientVersion(),
+			return c.validateLogin(conn, api.SftpAuthRequest{
+				Type: api.SftpAuthPassword,
+				Pass: string(pass),
+			})
+		},
+		// Public keys are validated by sending the fingerprint of the key to the Panel, which
+		// determines if the key belongs to a user that has access to the server.
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return c.validateLogin(conn, api.SftpAuthRequest{
+				Type: api.SftpAuthPublicKey,
+				Key:  ssh.FingerprintSHA256(key),
 			})
-
-			if err != nil {
-				return nil, err
-			}
-
-			sshPerm := &ssh.Permissions{
-				Extensions: map[string]string{
-					"uuid":        resp.Server,
-					"user":        conn.User(),
-					"permissions": strings.Join(resp.Permissions, ","),
-				},
-			}
-
-			return sshPerm, nil
 		},
 	}
 
@@ -120,6 +117,63 @@ func (c *Server) Initialize() error {
 	}
 }
 
+// Validates a login attempt using the credential validator and returns the permissions to
+// assign to the connection if it was successful. The connection metadata is added to the
+// request before it is sent along.
+func (c *Server) validateLogin(conn ssh.ConnMetadata, r api.SftpAuthRequest) (*ssh.Permissions, error) {
+	r.User = conn.User()
+	r.IP = conn.RemoteAddr().String()
+	r.SessionID = conn.SessionID()
+	r.ClientVersion = conn.ClientVersion()
+
+	// Don't even bother asking the Panel if the IP address or username has failed to login
+	// too many times recently.
+	ip := remoteIp(conn.RemoteAddr())
+	if until, ok := bans.blocked(ip, r.User); ok {
+		log.WithFields(log.Fields{
+			"subsystem": "sftp",
+			"username":  r.User,
+			"ip":        r.IP,
+			"until":     until,
+		}).Debug("rejecting login attempt from blocked ip address or username")
+
+		return nil, ErrLoginBlocked
+	}
+
+	resp, err := c.CredentialValidator(r)
+	if err != nil {
+		// Only invalid credentials are counted as a failed attempt, the Panel being unavailable
+		// should not result in users being locked out. Clients offer every public key they have
+		// until one is accepted, so rejected keys are not counted either.
+		if api.IsInvalidCredentialsError(err) && r.Type == api.SftpAuthPassword {
+			if until := bans.fail(ip, r.User); !until.IsZero() {
+				publishBlocked(ip, r.User, until)
+			}
+		}
+
+		return nil, err
+	}
+
+	bans.succeed(ip, r.User)
+
+	// Paths may contain any character, so they are encoded rather than joined together.
+	paths, err := json.Marshal(resp.Paths)
+	if err != nil {
+		return nil, err
+	}
+
+	sshPerm := &ssh.Permissions{
+		Extensions: map[string]string{
+			"uuid":        resp.Server,
+			"user":        conn.User(),
+			"permissions": strings.Join(resp.Permissions, ","),
+			"paths":       string(paths),
+		},
+	}
+
+	return sshPerm, nil
+}
+
 // Handles an inbound connection to the instance and determines if we should serve the request
 // or not.
 func (c Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
@@ -134,6 +188,13 @@ func (c Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig)
 
 	go ssh.DiscardRequests(reqs)
 
+	// Track the connection so that it can be listed, and disconnected, through the API.
+	var session *Session
+	if sconn.Permissions.Extensions["uuid"] != "" {
+		session = sessions.add(sconn)
+		defer sessions.remove(session.ID)
+	}
+
 	for newChannel := range chans {
 		// If its not a session channel we just move on because its not something we
 		// know how to handle at this point.
@@ -147,52 +208,109 @@ func (c Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig)
 			continue
 		}
 
-		// Channels have a type that is dependent on the protocol. For SFTP this is "subsystem"
-		// with a payload that (should) be "sftp". Discard anything else we receive ("pty", "shell", etc)
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				ok := false
-
-				switch req.Type {
-				case "subsystem":
-					if string(req.Payload[4:]) == "sftp" {
-						ok = true
-					}
-				}
-
-				req.Reply(ok, nil)
-			}
-		}(requests)
-
 		// Configure the user's home folder for the rest of the request cycle.
 		if sconn.Permissions.Extensions["uuid"] == "" {
+			channel.Close()
 			continue
 		}
 
-		// Create a new handler for the currently logged in user's server.
-		fs := c.createHandler(sconn)
+		go c.handleSession(sconn, session, channel, requests)
+	}
+}
+
+// Handles the requests made on a session channel. Channels have a type that is dependent on
+// the protocol. For SFTP this is "subsystem" with a payload that (should) be "sftp", while a
+// "shell" request attaches the user to the server console. Discard anything else we receive.
+func (c Server) handleSession(sconn *ssh.ServerConn, session *Session, channel ssh.Channel, requests <-chan *ssh.Request) {
+	var started bool
+	var pty *ptyRequest
+	var console *consoleSession
+
+	for req := range requests {
+		ok := false
+		var start func()
+
+		switch req.Type {
+		case "subsystem":
+			if !started && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp" {
+				ok = true
+				start = func() {
+					c.serveSftp(sconn, session, channel)
+				}
+			}
+		case "pty-req":
+			var p ptyRequest
+			if !started && ssh.Unmarshal(req.Payload, &p) == nil {
+				ok = true
+				pty = &p
+			}
+		case "window-change":
+			var w windowChangeRequest
+			if console != nil && ssh.Unmarshal(req.Payload, &w) == nil {
+				ok = true
+				console.resize(w.Columns, w.Rows)
+			}
+		case "shell":
+			if !started {
+				console, ok = c.openConsole(sconn, channel, pty)
+				if ok {
+					start = console.run
+				}
+			}
+		}
 
-		// Create the server instance for the channel using the filesystem we created above.
-		server := sftp.NewRequestServer(channel, fs)
+		req.Reply(ok, nil)
 
-		if err := server.Serve(); err == io.EOF {
-			server.Close()
+		// Only start handling the session once the request has been replied to, otherwise
+		// the client could receive data before it knows the request was accepted.
+		if start != nil {
+			started = true
+			go start()
 		}
 	}
 }
 
+// Serves SFTP requests on the channel until the client disconnects.
+func (c Server) serveSftp(sconn *ssh.ServerConn, session *Session, channel ssh.Channel) {
+	// Create a new handler for the currently logged in user's server.
+	fs, err := c.createHandler(sconn, session)
+	if err != nil {
+		log.WithField("subsystem", "sftp").WithField("error", err).Error("failed to create handler for sftp session")
+		channel.Close()
+		return
+	}
+
+	// Create the server instance for the channel using the filesystem we created above.
+	server := sftp.NewRequestServer(channel, fs)
+
+	if err := server.Serve(); err == io.EOF {
+		server.Close()
+	}
+}
+
 // Creates a new SFTP handler for a given server. The directory argument should
 // be the base directory for a server. All actions done on the server will be
 // relative to that directory, and the user will not be able to escape out of it.
-func (c Server) createHandler(sc *ssh.ServerConn) sftp.Handlers {
+func (c Server) createHandler(sc *ssh.ServerConn, session *Session) (sftp.Handlers, error) {
+	paths, err := allowedPaths(sc.Permissions.Extensions["paths"])
+	if err != nil {
+		return sftp.Handlers{}, err
+	}
+
 	p := FileSystem{
 		UUID:          sc.Permissions.Extensions["uuid"],
 		Permissions:   strings.Split(sc.Permissions.Extensions["permissions"], ","),
+		Root:          path.Join(c.Settings.BasePath, sc.Permissions.Extensions["uuid"]),
+		Paths:         paths,
 		ReadOnly:      c.Settings.ReadOnly,
 		Cache:         c.cache,
 		User:          c.User,
+		Username:      sc.User(),
+		IP:            remoteIp(sc.RemoteAddr()),
 		HasDiskSpace:  c.DiskSpaceValidator,
+		DiskUsage:     c.DiskUsageResolver,
 		PathValidator: c.PathValidator,
+		session:       session,
 		logger: log.WithFields(log.Fields{
 			"subsystem": "sftp",
 			"username":  sc.User(),
@@ -205,7 +323,35 @@ func (c Server) createHandler(sc *ssh.ServerConn) sftp.Handlers {
 		FilePut:  p,
 		FileCmd:  p,
 		FileList: p,
+	}, nil
+}
+
+// Returns the cleaned up list of paths a user is limited to from the encoded list stored on the
+// connection. If the list cannot be decoded an error is returned, rather than allowing the user
+// to access every file.
+func allowedPaths(encoded string) ([]string, error) {
+	var paths []string
+	if err := json.Unmarshal([]byte(encoded), &paths); err != nil {
+		return nil, errors.Wrap(err, "sftp: could not decode allowed paths")
 	}
+
+	return AllowedPaths(paths), nil
+}
+
+// Returns the cleaned up list of paths a user is limited to. If the user is allowed to access
+// the root of the server no paths are returned, since every file can be accessed anyways.
+func AllowedPaths(paths []string) []string {
+	var out []string
+	for _, p := range paths {
+		p = path.Clean("/" + p)
+		if p == "/" {
+			return nil
+		}
+
+		out = append(out, p)
+	}
+
+	return out
 }
 
 // Generates a private key that will be used by the SFTP server.
@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A user that is connected to the SFTP server. The number of bytes only includes the contents
+// of files that were read or written, not any of the other traffic on the connection.
+type Session struct {
+	// These are updated atomically, so they need to be first in the struct to be aligned
+	// correctly on 32-bit systems.
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+
+	ID        string    `json:"id"`
+	Server    string    `json:"server"`
+	User      string    `json:"username"`
+	IP        string    `json:"ip"`
+	StartedAt time.Time `json:"started_at"`
+
+	conn *ssh.ServerConn
+}
+
+type sessionCollection struct {
+	mu    sync.RWMutex
+	items map[string]*Session
+}
+
+var sessions = &sessionCollection{items: make(map[string]*Session)}
+
+// Starts tracking a connection that has logged in to the SFTP server.
+func (c *sessionCollection) add(conn *ssh.ServerConn) *Session {
+	s := &Session{
+		ID:        uuid.New().String(),
+		Server:    conn.Permissions.Extensions["uuid"],
+		User:      conn.User(),
+		IP:        remoteIp(conn.RemoteAddr()),
+		StartedAt: time.Now(),
+		conn:      conn,
+	}
+
+	c.mu.Lock()
+	c.items[s.ID] = s
+	c.mu.Unlock()
+
+	return s
+}
+
+// Stops tracking a session once the connection has been closed.
+func (c *sessionCollection) remove(id string) {
+	c.mu.Lock()
+	delete(c.items, id)
+	c.mu.Unlock()
+}
+
+// Returns all of the sessions matching the filter.
+func (c *sessionCollection) filter(f func(s *Session) bool) []*Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var out []*Session
+	for _, s := range c.items {
+		if f(s) {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// Returns every active session for a server, ordered by when they were started.
+func Sessions(server string) []Session {
+	out := make([]Session, 0)
+	for _, s := range sessions.filter(func(s *Session) bool { return s.Server == server }) {
+		out = append(out, Session{
+			BytesRead:    atomic.LoadInt64(&s.BytesRead),
+			BytesWritten: atomic.LoadInt64(&s.BytesWritten),
+			ID:           s.ID,
+			Server:       s.Server,
+			User:         s.User,
+			IP:           s.IP,
+			StartedAt:    s.StartedAt,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartedAt.Before(out[j].StartedAt)
+	})
+
+	return out
+}
+
+// Closes the connection for a session on the server. Returns false if there is no session with
+// that ID for the server.
+func Disconnect(server string, id string) bool {
+	s := sessions.filter(func(s *Session) bool { return s.Server == server && s.ID == id })
+	if len(s) == 0 {
+		return false
+	}
+
+	_ = s[0].conn.Close()
+
+	return true
+}
+
+// Closes the connection for every session on the server. This is used when a server is
+// suspended or deleted, since any users connected to it should no longer have access.
+func DisconnectServer(server string) {
+	for _, s := range sessions.filter(func(s *Session) bool { return s.Server == server }) {
+		_ = s.conn.Close()
+	}
+}
+
+// A file opened over SFTP that counts the number of bytes read from and written to it for the
+// session that opened it.
+type sessionFile struct {
+	*os.File
+	session *Session
+}
+
+// Wraps a file so that the bytes read from and written to it are counted for the session.
+func (fs FileSystem) track(f *os.File) *sessionFile {
+	return &sessionFile{File: f, session: fs.session}
+}
+
+func (f *sessionFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if f.session != nil {
+		atomic.AddInt64(&f.session.BytesRead, int64(n))
+	}
+
+	return n, err
+}
+
+func (f *sessionFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if f.session != nil {
+		atomic.AddInt64(&f.session.BytesWritten, int64(n))
+	}
+
+	return n, err
+}
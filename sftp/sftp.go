@@ -25,12 +25,16 @@ func Initialize(config config.SystemConfiguration) error {
 		CredentialValidator: validateCredentials,
 		PathValidator:       validatePath,
 		DiskSpaceValidator:  validateDiskSpace,
+		DiskUsageResolver:   resolveDiskUsage,
 	}
 
 	if err := New(s); err != nil {
 		return errors.WithStack(err)
 	}
 
+	// Send any activity recorded for SFTP sessions to the Panel in batches.
+	go activity.process()
+
 	// Initialize the SFTP server in a background thread since this is
 	// a long running operation.
 	go func(s *Server) {
@@ -66,16 +70,32 @@ func validateDiskSpace(fs FileSystem) bool {
 	return s.Filesystem().HasSpaceAvailable(true)
 }
 
+// Returns the cached disk usage for the server and the maximum amount of disk space it is
+// allowed to use. The cached value is used to avoid walking the entire server directory each
+// time a client checks the available space.
+func resolveDiskUsage(fs FileSystem) (int64, int64, error) {
+	s := server.GetServers().Find(func(server *server.Server) bool {
+		return server.Id() == fs.UUID
+	})
+
+	if s == nil {
+		return 0, 0, noMatchingServerError
+	}
+
+	return s.Filesystem().CachedUsage(), s.Filesystem().MaxDisk(), nil
+}
+
 // Validates a set of credentials for a SFTP login against Pterodactyl Panel and returns
-// the server's UUID if the credentials were valid.
+// the server's UUID if the credentials were valid. The credentials are either a password or
+// the fingerprint of a public key.
 func validateCredentials(c api.SftpAuthRequest) (*api.SftpAuthResponse, error) {
-	f := log.Fields{"subsystem": "sftp", "username": c.User, "ip": c.IP}
+	f := log.Fields{"subsystem": "sftp", "username": c.User, "ip": c.IP, "method": c.Type}
 
 	log.WithFields(f).Debug("validating credentials for SFTP connection")
 	resp, err := api.New().ValidateSftpCredentials(c)
 	if err != nil {
 		if api.IsInvalidCredentialsError(err) {
-			log.WithFields(f).Warn("failed to validate user credentials (invalid username or password)")
+			log.WithFields(f).Warn("failed to validate user credentials (invalid username, password or key)")
 		} else {
 			log.WithFields(f).Error("encountered an error while trying to validate user credentials")
 		}
@@ -18,3 +18,13 @@ func (ab *AtomicBool) Set(v bool) {
 func (ab *AtomicBool) Get() bool {
 	return atomic.LoadUint32(&ab.flag) == 1
 }
+
+// Sets the value to v if it is not already v, returning true if the value was changed. The
+// check and update happen atomically, so only one caller is able to change the value.
+func (ab *AtomicBool) SwapIf(v bool) bool {
+	if v {
+		return atomic.CompareAndSwapUint32(&ab.flag, 0, 1)
+	}
+
+	return atomic.CompareAndSwapUint32(&ab.flag, 1, 0)
+}
@@ -0,0 +1,200 @@
+package system
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"io"
+	"sync"
+)
+
+// The largest number of bytes that will be passed through a rate limited reader or
+// writer in a single call. Splitting larger reads and writes up keeps the resulting
+// throughput smooth, rather than bursting and then stalling for long periods.
+const rateLimitChunkSize = 32 * 1024
+
+// A rate limiter that caps the combined throughput of every reader and writer that it is
+// attached to. The limit can be changed at any time, and a limit of zero or less disables the
+// limiter entirely.
+type RateLimiter struct {
+	mu    sync.Mutex
+	limit int64
+	l     *rate.Limiter
+}
+
+// Returns a new rate limiter that allows the given number of bytes per second.
+func NewRateLimiter(limit int64) *RateLimiter {
+	rl := &RateLimiter{l: rate.NewLimiter(rate.Inf, 0)}
+	rl.SetLimit(limit)
+
+	return rl
+}
+
+// Returns the number of bytes per second allowed by the limiter.
+func (rl *RateLimiter) Limit() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.limit
+}
+
+// Updates the number of bytes per second allowed by the limiter. Never more than a single
+// second worth of data is allowed to build up, otherwise a long idle period would allow a
+// massive burst of data through.
+func (rl *RateLimiter) SetLimit(limit int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limit = limit
+	if limit <= 0 {
+		rl.l.SetLimit(rate.Inf)
+		return
+	}
+
+	rl.l.SetBurst(int(limit))
+	rl.l.SetLimit(rate.Limit(limit))
+}
+
+// Blocks until n bytes are allowed to be processed by the caller.
+func (rl *RateLimiter) Wait(n int) {
+	for n > 0 {
+		// The limiter refuses to wait for more than its burst at once, so anything larger
+		// than the limit is waited for in pieces.
+		c := n
+		if b := rl.l.Burst(); b > 0 && c > b {
+			c = b
+		}
+
+		// This only fails if the burst was lowered while waiting, in which case trying again
+		// with the new burst is all that is needed.
+		if err := rl.l.WaitN(context.Background(), c); err != nil && rl.l.Limit() != rate.Inf {
+			continue
+		}
+
+		n -= c
+	}
+}
+
+// Returns a reader that is limited by this rate limiter.
+func (rl *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &rateLimitedReader{r: r, rl: rl}
+}
+
+// Returns a writer that is limited by this rate limiter.
+func (rl *RateLimiter) Writer(w io.Writer) io.Writer {
+	return &rateLimitedWriter{w: w, rl: rl}
+}
+
+type rateLimitedReader struct {
+	r  io.Reader
+	rl *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunkSize {
+		p = p[:rateLimitChunkSize]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.rl.Wait(n)
+	}
+
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	w  io.Writer
+	rl *RateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		c := p
+		if len(c) > rateLimitChunkSize {
+			c = c[:rateLimitChunkSize]
+		}
+
+		w.rl.Wait(len(c))
+		n, err := w.w.Write(c)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// A group of rate limiters where every member of the group is limited individually, and the
+// combined throughput of every member is also capped. Both limits can be changed at any time,
+// and the change applies to members that are already in use.
+type RateLimitGroup struct {
+	mu      sync.Mutex
+	shared  *RateLimiter
+	each    int64
+	members map[*RateLimiter]struct{}
+}
+
+// Returns a new rate limit group with the given total limit, and limit for each member.
+func NewRateLimitGroup(total int64, each int64) *RateLimitGroup {
+	return &RateLimitGroup{
+		shared:  NewRateLimiter(total),
+		each:    each,
+		members: make(map[*RateLimiter]struct{}),
+	}
+}
+
+// Updates the limits for the group and every member currently in it. Limits that have not
+// changed are left alone, so this is safe to call frequently.
+func (g *RateLimitGroup) SetLimits(total int64, each int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.shared.Limit() != total {
+		g.shared.SetLimit(total)
+	}
+
+	if g.each != each {
+		g.each = each
+		for m := range g.members {
+			m.SetLimit(each)
+		}
+	}
+}
+
+// Adds a new member to the group. The member must be released once it is no longer being used.
+func (g *RateLimitGroup) Acquire() *RateLimitGroupMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	m := NewRateLimiter(g.each)
+	g.members[m] = struct{}{}
+
+	return &RateLimitGroupMember{group: g, rl: m}
+}
+
+// A single member of a rate limit group.
+type RateLimitGroupMember struct {
+	group *RateLimitGroup
+	rl    *RateLimiter
+}
+
+// Returns a reader that is limited by both the member and the group limits.
+func (m *RateLimitGroupMember) Reader(r io.Reader) io.Reader {
+	return m.group.shared.Reader(m.rl.Reader(r))
+}
+
+// Returns a writer that is limited by both the member and the group limits.
+func (m *RateLimitGroupMember) Writer(w io.Writer) io.Writer {
+	return m.rl.Writer(m.group.shared.Writer(w))
+}
+
+// Removes the member from the group.
+func (m *RateLimitGroupMember) Release() {
+	m.group.mu.Lock()
+	delete(m.group.members, m.rl)
+	m.group.mu.Unlock()
+}
@@ -0,0 +1,325 @@
+package webdav
+
+import (
+	"context"
+	"github.com/apex/log"
+	"github.com/pterodactyl/wings/server"
+	"github.com/pterodactyl/wings/sftp"
+	"golang.org/x/net/webdav"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Implements the WebDAV filesystem for a single server using the permissions of the user that
+// logged in. Every path is resolved through the server's filesystem so that users are never
+// able to access anything outside of the server's data directory.
+type FileSystem struct {
+	Server      *server.Server
+	Permissions []string
+	Paths       []string
+	ReadOnly    bool
+
+	logger *log.Entry
+}
+
+var _ webdav.FileSystem = (*FileSystem)(nil)
+
+// Determines if the user has the given permission. The same rules as the SFTP server are used.
+func (fs *FileSystem) can(permission string) bool {
+	return sftp.HasPermission(fs.Permissions, permission)
+}
+
+// Determines if a path is within one of the paths the user is limited to. If parents is true the
+// directories leading up to the allowed paths are included so that they can be navigated.
+func (fs *FileSystem) inScope(p string, parents bool) bool {
+	return sftp.InScope(fs.Paths, p, parents)
+}
+
+// Returns the full path to a file on the system after confirming that the user can access it.
+func (fs *FileSystem) resolve(name string, parents bool) (string, error) {
+	if !fs.inScope(name, parents) {
+		return "", os.ErrNotExist
+	}
+
+	p, err := fs.Server.Filesystem().SafePath(name)
+	if err != nil {
+		return "", os.ErrPermission
+	}
+
+	// A symlink within one of the allowed paths could point somewhere outside of them, so the
+	// resolved location needs to be checked as well.
+	rel := strings.TrimPrefix(p, fs.Server.Filesystem().Path())
+	if !fs.inScope(rel, parents) {
+		return "", os.ErrNotExist
+	}
+
+	return p, nil
+}
+
+// Returns an error if the user is not allowed to modify files for the server.
+func (fs *FileSystem) writable() error {
+	if fs.ReadOnly {
+		return os.ErrPermission
+	}
+
+	return nil
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := fs.writable(); err != nil {
+		return err
+	}
+
+	if !fs.can(sftp.PermissionFileCreate) {
+		return os.ErrPermission
+	}
+
+	p, err := fs.resolve(name, false)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(p, 0755); err != nil {
+		return err
+	}
+
+	return fs.Server.Filesystem().Chown(name)
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+
+	p, err := fs.resolve(name, !write)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if write {
+		if werr := fs.writable(); werr != nil {
+			return nil, werr
+		}
+
+		// Creating a new file and modifying an existing one require different permissions.
+		if os.IsNotExist(err) {
+			if !fs.can(sftp.PermissionFileCreate) {
+				return nil, os.ErrPermission
+			}
+		} else if st.IsDir() {
+			return nil, os.ErrPermission
+		} else if !fs.can(sftp.PermissionFileUpdate) {
+			return nil, os.ErrPermission
+		}
+
+		// WebDAV always replaces the entire contents of a file when writing to it. A file that
+		// is opened for writing without being truncated is only having its properties changed,
+		// which are not supported, so it can be opened for reading instead.
+		if flag&os.O_TRUNC != 0 {
+			return fs.create(ctx, name, p)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if st.IsDir() {
+		if !fs.can(sftp.PermissionFileRead) {
+			return nil, os.ErrPermission
+		}
+	} else if !fs.can(sftp.PermissionFileReadContent) {
+		return nil, os.ErrPermission
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &file{File: f, fs: fs, ctx: ctx}, nil
+}
+
+// Returns a file that writes everything to the server's filesystem, so that the disk space
+// available to the server is enforced and its disk usage is kept up to date.
+func (fs *FileSystem) create(ctx context.Context, name string, p string) (webdav.File, error) {
+	// Clients expect to receive a conflict when the directory a file is being created in does
+	// not exist, rather than it being created for them.
+	if st, err := os.Stat(filepath.Dir(p)); err != nil {
+		return nil, err
+	} else if !st.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	pr, pw := io.Pipe()
+	u := &upload{path: p, ctx: ctx, pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		err := fs.Server.Filesystem().Writefile(name, pr)
+		if err != nil {
+			fs.logger.WithField("path", name).WithField("error", err).Warn("failed to write file")
+		}
+
+		// Stop any further writes if the file could not be written, otherwise they would
+		// block forever waiting for something to read them.
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+
+	return u, nil
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if err := fs.writable(); err != nil {
+		return err
+	}
+
+	if !fs.can(sftp.PermissionFileDelete) {
+		return os.ErrPermission
+	}
+
+	if _, err := fs.resolve(name, false); err != nil {
+		return err
+	}
+
+	return fs.Server.Filesystem().Delete(name)
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if err := fs.writable(); err != nil {
+		return err
+	}
+
+	if !fs.can(sftp.PermissionFileUpdate) {
+		return os.ErrPermission
+	}
+
+	if _, err := fs.resolve(oldName, false); err != nil {
+		return err
+	}
+
+	if _, err := fs.resolve(newName, false); err != nil {
+		return err
+	}
+
+	return fs.Server.Filesystem().Rename(oldName, newName)
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if !fs.can(sftp.PermissionFileRead) {
+		return nil, os.ErrPermission
+	}
+
+	p, err := fs.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Stat(p)
+}
+
+// A file or directory opened through WebDAV. Directory listings hide anything outside of the
+// paths the user is limited to. Reads stop once the request has been cancelled, which happens
+// when the server is suspended or deleted.
+type file struct {
+	*os.File
+	fs  *FileSystem
+	ctx context.Context
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return f.File.Read(p)
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	files, err := f.File.Readdir(count)
+	if len(f.fs.Paths) == 0 {
+		return files, err
+	}
+
+	// The directory that was actually opened is used rather than the requested name, since the
+	// two differ if a symlink was followed.
+	rel, rerr := filepath.Rel(f.fs.Server.Filesystem().Path(), f.File.Name())
+	if rerr != nil {
+		return nil, os.ErrNotExist
+	}
+
+	visible := make([]os.FileInfo, 0, len(files))
+	for _, fi := range files {
+		if f.fs.inScope(path.Join("/"+rel, fi.Name()), true) {
+			visible = append(visible, fi)
+		}
+	}
+
+	return visible, err
+}
+
+// A file being written through WebDAV. Everything written to it is passed along to the server's
+// filesystem, and the file is only complete once it has been closed.
+type upload struct {
+	path string
+	ctx  context.Context
+	pw   *io.PipeWriter
+	done chan error
+
+	once sync.Once
+	err  error
+}
+
+var _ webdav.File = (*upload)(nil)
+
+func (u *upload) Write(p []byte) (int, error) {
+	if err := u.ctx.Err(); err != nil {
+		u.pw.CloseWithError(err)
+		return 0, err
+	}
+
+	return u.pw.Write(p)
+}
+
+// Finishes writing the file and waits for the server's filesystem to be done with it.
+func (u *upload) finish() error {
+	u.once.Do(func() {
+		u.pw.Close()
+		u.err = <-u.done
+	})
+
+	return u.err
+}
+
+func (u *upload) Close() error {
+	return u.finish()
+}
+
+// Returns the details of the file once it has been written. WebDAV uses these to generate the
+// ETag that is returned for the upload.
+func (u *upload) Stat() (os.FileInfo, error) {
+	if err := u.finish(); err != nil {
+		return nil, err
+	}
+
+	return os.Stat(u.path)
+}
+
+func (u *upload) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (u *upload) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (u *upload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
@@ -0,0 +1,259 @@
+package webdav
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/pterodactyl/wings/api"
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/server"
+	"github.com/pterodactyl/wings/sftp"
+	"golang.org/x/net/webdav"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebDAV clients send a large number of requests when browsing files, so successful logins are
+// remembered for a short time rather than asking the Panel to validate every single request.
+var logins = cache.New(30*time.Second, time.Minute)
+
+// Tracks the lock system and the requests being handled for every server that is accessed
+// over WebDAV.
+type serverCollection struct {
+	mu       sync.Mutex
+	locks    map[string]webdav.LockSystem
+	requests map[string]map[*http.Request]context.CancelFunc
+}
+
+var servers = &serverCollection{
+	locks:    make(map[string]webdav.LockSystem),
+	requests: make(map[string]map[*http.Request]context.CancelFunc),
+}
+
+type handler struct {
+	readOnly bool
+}
+
+// Starts the WebDAV server if it is enabled in the configuration. Users login using the same
+// credentials they use for the SFTP server, and are only able to access the files for the
+// server those credentials belong to.
+func Initialize(c *config.Configuration) error {
+	if !c.System.WebDav.Enabled {
+		return nil
+	}
+
+	h := &handler{readOnly: c.System.Sftp.ReadOnly}
+
+	// Clients that never finish sending a request would otherwise keep the connection open
+	// forever. The time allowed to read an entire request is generous since it includes the
+	// time taken to upload a file.
+	s := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", c.System.WebDav.Address, c.System.WebDav.Port),
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Hour,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	l := log.WithFields(log.Fields{"subsystem": "webdav", "host": c.System.WebDav.Address, "port": c.System.WebDav.Port})
+
+	if !c.Api.Ssl.Enabled {
+		l.Warn("webdav subsystem is not using ssl, user credentials will be sent over the network in plain text")
+	}
+
+	go func() {
+		l.Info("webdav subsystem listening for connections")
+
+		var err error
+		if c.Api.Ssl.Enabled {
+			err = s.ListenAndServeTLS(c.Api.Ssl.CertificateFile, c.Api.Ssl.KeyFile)
+		} else {
+			err = s.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			l.WithField("error", errors.WithStack(err)).Error("failed to initialize WebDAV subsystem")
+		}
+	}()
+
+	return nil
+}
+
+// Returns the lock system for a server, creating it if it does not exist yet. Locks are kept
+// per server so that users of one server are never able to see the locks held on another.
+func (c *serverCollection) lockSystem(id string) webdav.LockSystem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ls, ok := c.locks[id]
+	if !ok {
+		ls = webdav.NewMemLS()
+		c.locks[id] = ls
+	}
+
+	return ls
+}
+
+// Starts tracking a request for a server. The returned request is cancelled if the server is
+// disconnected, and the returned function must be called once the request is complete.
+func (c *serverCollection) track(id string, r *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+
+	c.mu.Lock()
+	if c.requests[id] == nil {
+		c.requests[id] = make(map[*http.Request]context.CancelFunc)
+	}
+	c.requests[id][r] = cancel
+	c.mu.Unlock()
+
+	return r, func() {
+		c.mu.Lock()
+		delete(c.requests[id], r)
+		if len(c.requests[id]) == 0 {
+			delete(c.requests, id)
+		}
+		c.mu.Unlock()
+
+		cancel()
+	}
+}
+
+// Cancels every request being handled for a server and forgets its locks.
+func (c *serverCollection) disconnect(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cancel := range c.requests[id] {
+		cancel()
+	}
+
+	delete(c.requests, id)
+	delete(c.locks, id)
+}
+
+// Stops every request being handled for a server and forgets any logins that were cached for
+// it, so that users have to login again. This is used when a server is suspended or deleted,
+// since any users connected to it should no longer have access.
+func DisconnectServer(id string) {
+	for k, v := range logins.Items() {
+		if v.Object.(*api.SftpAuthResponse).Server == id {
+			logins.Delete(k)
+		}
+	}
+
+	servers.disconnect(id)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		unauthorized(w)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	resp, err := login(user, pass, ip)
+	if err != nil {
+		if api.IsInvalidCredentialsError(err) || err == sftp.ErrLoginBlocked {
+			unauthorized(w)
+		} else {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	s := server.GetServers().Find(func(s *server.Server) bool {
+		return s.Id() == resp.Server
+	})
+
+	if s == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// The request is tracked before checking if the server is suspended, so that it is always
+	// cancelled if the server is suspended while it is being handled.
+	r, done := servers.track(s.Id(), r)
+	defer done()
+
+	if s.IsSuspended() {
+		http.Error(w, "This server is currently suspended.", http.StatusForbidden)
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"subsystem": "webdav", "server": s.Id(), "username": user, "ip": ip})
+
+	dav := &webdav.Handler{
+		FileSystem: &FileSystem{
+			Server:      s,
+			Permissions: resp.Permissions,
+			Paths:       sftp.AllowedPaths(resp.Paths),
+			ReadOnly:    h.readOnly,
+			logger:      logger,
+		},
+		LockSystem: servers.lockSystem(s.Id()),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path, "error": err}).Debug("failed to handle webdav request")
+			}
+		},
+	}
+
+	dav.ServeHTTP(w, r)
+}
+
+// Validates the credentials with the Panel, unless they were successfully used recently. Logins
+// count towards the same lockout as the SFTP server.
+func login(user string, pass string, ip string) (*api.SftpAuthResponse, error) {
+	sum := sha256.Sum256([]byte(user + "\x00" + pass))
+	key := hex.EncodeToString(sum[:])
+
+	if v, ok := logins.Get(key); ok {
+		return v.(*api.SftpAuthResponse), nil
+	}
+
+	if sftp.LoginBlocked(ip, user) {
+		return nil, sftp.ErrLoginBlocked
+	}
+
+	resp, err := api.New().ValidateSftpCredentials(api.SftpAuthRequest{
+		Type: api.SftpAuthPassword,
+		User: user,
+		Pass: pass,
+		IP:   ip,
+	})
+
+	sftp.RecordLogin(ip, user, err)
+
+	if err != nil {
+		if api.IsInvalidCredentialsError(err) {
+			log.WithFields(log.Fields{"subsystem": "webdav", "username": user, "ip": ip}).Warn("failed to validate user credentials (invalid username or password)")
+		} else {
+			log.WithFields(log.Fields{"subsystem": "webdav", "username": user, "ip": ip, "error": err}).Error("encountered an error while trying to validate user credentials")
+		}
+
+		return nil, err
+	}
+
+	logins.Set(key, resp, cache.DefaultExpiration)
+
+	return resp, nil
+}
+
+// Asks the client to provide credentials for the request.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Pterodactyl", charset="UTF-8"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}